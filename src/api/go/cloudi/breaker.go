@@ -0,0 +1,313 @@
+package cloudi
+
+//-*-Mode:Go;coding:utf-8;tab-width:4;c-basic-offset:4-*-
+// ex: set ft=go fenc=utf-8 sts=4 ts=4 sw=4 noet nomod:
+//
+// MIT License
+//
+// Copyright (c) 2017-2020 Michael Truog <mjtruog at protonmail dot com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+// DEALINGS IN THE SOFTWARE.
+//
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of a circuit
+type BreakerState int
+
+const (
+	// BreakerClosed sends service requests
+	BreakerClosed BreakerState = iota
+	// BreakerOpen fails service requests without sending them
+	BreakerOpen
+	// BreakerHalfOpen sends a single trial service request at a time
+	BreakerHalfOpen
+)
+
+func (state BreakerState) String() string {
+	switch state {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "invalid"
+	}
+}
+
+// BreakerPolicy configures a Breaker
+type BreakerPolicy struct {
+	// Failures is the number of consecutive failures that opens a circuit
+	Failures int
+	// OpenTimeout is the time a circuit is open before a trial
+	// service request is sent
+	OpenTimeout time.Duration
+	// Successes is the number of successful trial service requests
+	// that closes a circuit (0 is 1)
+	Successes int
+	// Patterns are service name patterns that share a circuit for
+	// all matching destination names
+	Patterns []string
+	// Failure selects the results that are failures
+	// (nil is BreakerFailure)
+	Failure func(response *Response, err error) bool
+	// Changed is called after a circuit changes state
+	Changed func(destination string, from, to BreakerState)
+}
+
+// Breaker is a circuit breaker for each destination of the
+// service requests sent with the WithBreaker option
+type Breaker struct {
+	policy   BreakerPolicy
+	circuits map[string]*breakerCircuit
+	lock     sync.Mutex
+}
+
+type breakerCircuit struct {
+	state     BreakerState
+	failures  int
+	successes int
+	opened    time.Time
+	trial     bool
+}
+
+// BreakerNew creates a Breaker
+func BreakerNew(policy BreakerPolicy) (*Breaker, error) {
+	if policy.Failures < 1 || policy.OpenTimeout < 0 || policy.Successes < 0 {
+		return nil, invalidInputErrorNew("policy")
+	}
+	for _, pattern := range policy.Patterns {
+		_, err := PatternCheck(pattern)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if policy.Successes == 0 {
+		policy.Successes = 1
+	}
+	if policy.Failure == nil {
+		policy.Failure = BreakerFailure
+	}
+	return &Breaker{policy: policy, circuits: map[string]*breakerCircuit{}}, nil
+}
+
+// WithBreaker sends the service request with the Breaker
+func WithBreaker(breaker *Breaker) SendOption {
+	return func(options *sendOptions) error {
+		if options.recv || breaker == nil {
+			return invalidInputErrorNew("breaker")
+		}
+		options.breaker = breaker
+		return nil
+	}
+}
+
+// BreakerFailure is a failure for an error or an empty response
+// (e.g., a timeout), unless the context was cancelled or the input
+// was invalid
+func BreakerFailure(response *Response, err error) bool {
+	if err != nil {
+		var invalid *InvalidInputError
+		if errors.As(err, &invalid) {
+			return false
+		}
+		return !errors.Is(err, context.Canceled)
+	}
+	return RetryEmpty(response, err)
+}
+
+// State returns the state of the circuit for the destination
+func (breaker *Breaker) State(name string) BreakerState {
+	destination := breaker.destination(name)
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+	circuit, found := breaker.circuits[destination]
+	if !found {
+		return BreakerClosed
+	}
+	if circuit.state == BreakerOpen && time.Since(circuit.opened) >= breaker.policy.OpenTimeout {
+		return BreakerHalfOpen
+	}
+	return circuit.state
+}
+
+// Forward forwards the service request unless the circuit for the
+// destination is open (the result of a forward is not known, so it is not
+// a trial service request for a half-open circuit)
+func (breaker *Breaker) Forward(request *Request, name string, requestInfo, requestData []byte, timeout uint32, priority int8) (*Response, error) {
+	if breaker.State(name) == BreakerOpen {
+		return nil, breakerOpenErrorNew(breaker.destination(name))
+	}
+	return request.Forward(name, requestInfo, requestData, timeout, priority)
+}
+
+// destination provides the circuit key for the service name
+func (breaker *Breaker) destination(name string) string {
+	for _, pattern := range breaker.policy.Patterns {
+		match, err := PatternMatch(pattern, name)
+		if err == nil && match {
+			return pattern
+		}
+	}
+	return name
+}
+
+func (breaker *Breaker) attempt(name string, attempt sendAttempt) sendAttempt {
+	destination := breaker.destination(name)
+	return func(requestInfo []byte, options *sendOptions) (*Response, []byte, error) {
+		trial, err := breaker.acquire(destination)
+		if err != nil {
+			return nil, nil, err
+		}
+		response, transId, err := attempt(requestInfo, options)
+		outcome := breakerOutcomeSuccess
+		if breakerNeutral(err) {
+			outcome = breakerOutcomeNeutral
+		} else if breaker.policy.Failure(response, err) {
+			outcome = breakerOutcomeFailure
+		}
+		breaker.release(destination, trial, outcome)
+		return response, transId, err
+	}
+}
+
+// acquire allows a service request to be sent
+// (as the trial service request if the circuit is half-open)
+func (breaker *Breaker) acquire(destination string) (bool, error) {
+	breaker.lock.Lock()
+	circuit, found := breaker.circuits[destination]
+	if !found {
+		circuit = &breakerCircuit{}
+		breaker.circuits[destination] = circuit
+	}
+	from := circuit.state
+	switch circuit.state {
+	case BreakerOpen:
+		if time.Since(circuit.opened) < breaker.policy.OpenTimeout {
+			breaker.lock.Unlock()
+			return false, breakerOpenErrorNew(destination)
+		}
+		circuit.state = BreakerHalfOpen
+		circuit.successes = 0
+		circuit.trial = true
+	case BreakerHalfOpen:
+		if circuit.trial {
+			breaker.lock.Unlock()
+			return false, breakerOpenErrorNew(destination)
+		}
+		circuit.trial = true
+	}
+	to := circuit.state
+	breaker.lock.Unlock()
+	breaker.changed(destination, from, to)
+	return to == BreakerHalfOpen, nil
+}
+
+// breakerOutcome is the result of a service request sent with a Breaker
+type breakerOutcome int
+
+const (
+	breakerOutcomeSuccess breakerOutcome = iota
+	breakerOutcomeFailure
+	// breakerOutcomeNeutral is neither a success nor a failure
+	// (the destination did not provide a result)
+	breakerOutcomeNeutral
+)
+
+// breakerNeutral returns true if the service request did not reach
+// the destination because the context was cancelled or the input
+// was invalid
+func breakerNeutral(err error) bool {
+	var invalid *InvalidInputError
+	return errors.Is(err, context.Canceled) || errors.As(err, &invalid)
+}
+
+// release records the result of a service request
+func (breaker *Breaker) release(destination string, trial bool, outcome breakerOutcome) {
+	breaker.lock.Lock()
+	circuit := breaker.circuits[destination]
+	from := circuit.state
+	switch circuit.state {
+	case BreakerClosed:
+		switch outcome {
+		case breakerOutcomeSuccess:
+			circuit.failures = 0
+		case breakerOutcomeFailure:
+			circuit.failures++
+			if circuit.failures >= breaker.policy.Failures {
+				circuit.state = BreakerOpen
+				circuit.opened = time.Now()
+			}
+		}
+	case BreakerHalfOpen:
+		if !trial {
+			// sent before the circuit opened
+			break
+		}
+		circuit.trial = false
+		switch outcome {
+		case breakerOutcomeSuccess:
+			circuit.successes++
+			if circuit.successes >= breaker.policy.Successes {
+				circuit.state = BreakerClosed
+				circuit.failures = 0
+			}
+		case breakerOutcomeFailure:
+			circuit.state = BreakerOpen
+			circuit.opened = time.Now()
+		}
+	}
+	to := circuit.state
+	breaker.lock.Unlock()
+	breaker.changed(destination, from, to)
+}
+
+func (breaker *Breaker) changed(destination string, from, to BreakerState) {
+	if from != to && breaker.policy.Changed != nil {
+		breaker.policy.Changed(destination, from, to)
+	}
+}
+
+// ErrBreakerOpen matches a BreakerOpenError with errors.Is
+var ErrBreakerOpen = errors.New("Circuit Open")
+
+// BreakerOpenError indicates a service request was not sent
+// because the circuit for the destination is open
+type BreakerOpenError struct {
+	Destination string
+}
+
+func breakerOpenErrorNew(destination string) error {
+	return &BreakerOpenError{Destination: destination}
+}
+func (e *BreakerOpenError) Error() string {
+	return "Circuit open for \"" + e.Destination + "\""
+}
+
+// Is provides errors.Is support for ErrBreakerOpen
+func (e *BreakerOpenError) Is(target error) bool {
+	return target == ErrBreakerOpen
+}
@@ -29,15 +29,19 @@ package cloudi
 import (
 	"bytes"
 	"container/list"
+	"context"
 	"encoding/binary"
 	"erlang"
+	"errors"
 	"fmt"
+	"io"
 	"math"
 	"net"
 	"os"
 	"reflect"
 	"runtime/debug"
 	"strconv"
+	"sync"
 	"time"
 	"unsafe"
 )
@@ -65,16 +69,30 @@ const (
 
 var nativeEndian binary.ByteOrder
 
+func init() {
+	switch byteOrder := uint16(0x00ff); *(*uint8)(unsafe.Pointer(&byteOrder)) {
+	case 0x00:
+		nativeEndian = binary.BigEndian
+	case 0xff:
+		nativeEndian = binary.LittleEndian
+	}
+}
+
 // Instance is an instance of the CloudI API
+// (an Instance may be used by many goroutines, though SendSync calls
+// are serialized because the CloudI core provides no way to associate
+// a synchronous response with its request, so concurrent requests
+// should use SendAsync with RecvAsync)
 type Instance struct {
 	state                  interface{}
+	threadIndex            uint32
 	socket                 net.Conn
 	useHeader              bool
 	initializationComplete bool
-	terminate              bool
 	fragmentSize           uint32
 	fragmentRecv           []byte
 	callbacks              map[string]*list.List
+	callbacksLock          sync.Mutex
 	bufferRecv             *bytes.Buffer
 	processIndex           uint32
 	processCount           uint32
@@ -86,11 +104,23 @@ type Instance struct {
 	timeoutSync            uint32
 	timeoutTerminate       uint32
 	priorityDefault        int8
-	responseInfo           []byte
-	response               []byte
-	transId                []byte
-	transIds               [][]byte
-	subscribeCount         uint32
+	lock                   sync.RWMutex
+	sendLock               sync.Mutex
+	replies                map[uint32]*replySlot
+	recvAsync              map[[16]byte]chan *reply
+	recvAsyncChanged       chan struct{}
+	recvAsyncLock          sync.Mutex
+	requests               *list.List
+	requestsReady          chan struct{}
+	requestsLock           sync.Mutex
+	terminated             chan struct{}
+	terminateOnce          sync.Once
+	closed                 chan struct{}
+	errRecv                error
+	active                 map[[16]byte]*Request
+	activeLock             sync.Mutex
+	metrics                *Metrics
+	traceExporter          SpanExporter
 }
 
 // Source is the Erlang pid that is the source of the service request
@@ -99,6 +129,69 @@ type Source erlang.OtpErlangPid
 // Callback is a function to handle a service request
 type Callback func(int, string, string, []byte, []byte, uint32, int8, [16]byte, Source, interface{}, *Instance) ([]byte, []byte, error)
 
+// ServeCloudI calls the Callback function with the Request data
+func (function Callback) ServeCloudI(request *Request) (*Response, error) {
+	responseInfo, response, err := function(request.RequestType, request.Name, request.Pattern, request.RequestInfo, request.Request, request.Timeout, request.Priority, request.TransId, request.Source, request.state, request.api)
+	return &Response{ResponseInfo: responseInfo, Response: response}, err
+}
+
+// Request is a service request provided to a Handler
+type Request struct {
+	// RequestType is ASYNC or SYNC
+	RequestType int
+	Name        string
+	Pattern     string
+	RequestInfo []byte
+	Request     []byte
+	Timeout     uint32
+	Priority    int8
+	TransId     [16]byte
+	Source      Source
+	state       interface{}
+	api         *Instance
+	responder   *Responder
+	deadline    time.Time
+	ctx         context.Context
+	cancel      context.CancelFunc
+	span        *Span
+}
+
+// API returns the CloudI API instance handling the service request
+func (request *Request) API() *Instance {
+	return request.api
+}
+
+// State returns the state provided when the CloudI API instance was created
+func (request *Request) State() interface{} {
+	return request.state
+}
+
+// Forward forwards the service request to a different service name
+// and provides the result the Handler must return (instead of a panic)
+func (request *Request) Forward(name string, requestInfo, requestData []byte, timeout uint32, priority int8) (*Response, error) {
+	_, _, err := request.api.ForwardTo(request.RequestType, name, requestInfo, requestData, timeout, priority, request.TransId, request.Source)
+	return nil, err
+}
+
+// Response is the response to a service request provided by a Handler
+type Response struct {
+	ResponseInfo []byte
+	Response     []byte
+}
+
+// Handler handles a service request
+type Handler interface {
+	ServeCloudI(request *Request) (*Response, error)
+}
+
+// HandlerFunc is a function that handles a service request as a Handler
+type HandlerFunc func(request *Request) (*Response, error)
+
+// ServeCloudI calls the HandlerFunc function
+func (function HandlerFunc) ServeCloudI(request *Request) (*Response, error) {
+	return function(request)
+}
+
 func nullResponse(requestType int, name, pattern string, requestInfo, request []byte, timeout uint32, priority int8, transId [16]byte, pid Source, state interface{}, api *Instance) ([]byte, []byte, error) {
 	return []byte{}, []byte{}, nil
 }
@@ -107,18 +200,12 @@ func nullResponse(requestType int, name, pattern string, requestInfo, request []
 func API(threadIndex uint32, state interface{}) (*Instance, error) {
 	protocol := os.Getenv("CLOUDI_API_INIT_PROTOCOL")
 	if protocol == "" {
-		return nil, invalidInputErrorNew()
+		return nil, invalidInputErrorNew("CLOUDI_API_INIT_PROTOCOL")
 	}
 	bufferSize, err := uintGetenv("CLOUDI_API_INIT_BUFFER_SIZE")
 	if err != nil {
 		return nil, err
 	}
-	switch byteOrder := uint16(0x00ff); *(*uint8)(unsafe.Pointer(&byteOrder)) {
-	case 0x00:
-		nativeEndian = binary.BigEndian
-	case 0xff:
-		nativeEndian = binary.LittleEndian
-	}
 	var socket net.Conn
 	socket, err = net.FileConn(os.NewFile(uintptr(threadIndex+3), strconv.Itoa(int(threadIndex))))
 	if err != nil {
@@ -142,17 +229,18 @@ func API(threadIndex uint32, state interface{}) (*Instance, error) {
 	bufferRecv := new(bytes.Buffer)
 	bufferRecv.Grow(int(bufferSize))
 	timeoutTerminate := uint32(10) // TIMEOUT_TERMINATE_MIN
-	api := &Instance{state: state, socket: socket, useHeader: useHeader, fragmentSize: bufferSize, fragmentRecv: fragmentRecv, callbacks: callbacks, bufferRecv: bufferRecv, timeoutTerminate: timeoutTerminate}
-	var init []byte
-	init, err = erlang.TermToBinary(erlang.OtpErlangAtom("init"), -1)
-	if err != nil {
-		return nil, err
-	}
-	err = api.send(init)
-	if err != nil {
-		return nil, err
-	}
-	_, err = api.pollRequest(-1, false)
+	replies := map[uint32]*replySlot{
+		messageInit:           replySlotNew(),
+		messageReturnAsync:    replySlotNew(),
+		messageReturnSync:     replySlotNew(),
+		messageReturnsAsync:   replySlotNew(),
+		messageSubscribeCount: replySlotNew(),
+	}
+	api := &Instance{state: state, threadIndex: threadIndex, socket: socket, useHeader: useHeader, fragmentSize: bufferSize, fragmentRecv: fragmentRecv, callbacks: callbacks, bufferRecv: bufferRecv, timeoutTerminate: timeoutTerminate, replies: replies, recvAsync: make(map[[16]byte]chan *reply), recvAsyncChanged: make(chan struct{}), requests: list.New(), active: make(map[[16]byte]*Request), requestsReady: make(chan struct{}, 1), terminated: make(chan struct{}), closed: make(chan struct{})}
+	go api.recvLoop()
+	_, err = api.request(context.Background(), messageInit, func() ([]byte, error) {
+		return erlang.TermToBinary(erlang.OtpErlangAtom("init"), -1)
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -160,19 +248,33 @@ func API(threadIndex uint32, state interface{}) (*Instance, error) {
 }
 
 // ThreadCount returns the thread count from the service configuration
+// (each thread requires a separate Instance to handle service requests concurrently)
 func ThreadCount() (uint32, error) {
 	return uintGetenv("CLOUDI_API_INIT_THREAD_COUNT")
 }
 
 // Subscribe subscribes to a service name pattern with a callback
 func (api *Instance) Subscribe(pattern string, function Callback) error {
+	if function == nil {
+		return invalidInputErrorNew("function")
+	}
+	return api.SubscribeHandler(pattern, function)
+}
+
+// SubscribeHandler subscribes to a service name pattern with a Handler
+func (api *Instance) SubscribeHandler(pattern string, handler Handler) error {
+	if handler == nil {
+		return invalidInputErrorNew("handler")
+	}
 	key := api.prefix + pattern
+	api.callbacksLock.Lock()
 	functionQueue := api.callbacks[key]
 	if functionQueue == nil {
 		functionQueue = list.New()
 		api.callbacks[key] = functionQueue
 	}
-	_ = functionQueue.PushBack(function)
+	_ = functionQueue.PushBack(handler)
+	api.callbacksLock.Unlock()
 	subscribe, err := erlang.TermToBinary([]interface{}{erlang.OtpErlangAtom("subscribe"), pattern}, -1)
 	if err != nil {
 		return err
@@ -186,29 +288,25 @@ func (api *Instance) Subscribe(pattern string, function Callback) error {
 
 // SubscribeCount returns the number of subscriptions for a single service name pattern
 func (api *Instance) SubscribeCount(pattern string) (uint32, error) {
-	subscribeCount, err := erlang.TermToBinary([]interface{}{erlang.OtpErlangAtom("subscribe_count"), pattern}, -1)
-	if err != nil {
-		return 0, err
-	}
-	err = api.send(subscribeCount)
+	result, err := api.request(context.Background(), messageSubscribeCount, func() ([]byte, error) {
+		return erlang.TermToBinary([]interface{}{erlang.OtpErlangAtom("subscribe_count"), pattern}, -1)
+	})
 	if err != nil {
 		return 0, err
 	}
-	_, err = api.pollRequest(-1, false)
-	if err != nil {
-		return 0, err
-	}
-	return api.subscribeCount, nil
+	return result.subscribeCount, nil
 }
 
 // Unsubscribe unsubscribes from a service name pattern once
 func (api *Instance) Unsubscribe(pattern string) error {
 	key := api.prefix + pattern
+	api.callbacksLock.Lock()
 	functionQueue := api.callbacks[key]
 	_ = functionQueue.Remove(functionQueue.Front())
 	if functionQueue.Len() == 0 {
 		api.callbacks[key] = nil
 	}
+	api.callbacksLock.Unlock()
 	unsubscribe, err := erlang.TermToBinary([]interface{}{erlang.OtpErlangAtom("unsubscribe"), pattern}, -1)
 	if err != nil {
 		return err
@@ -221,9 +319,24 @@ func (api *Instance) Unsubscribe(pattern string) error {
 }
 
 // SendAsync sends an asynchronous service request
+// (the timeout is not limited by a service request being handled, so use Request.SendAsync within a Handler)
 func (api *Instance) SendAsync(name string, requestInfo, request []byte, timeoutPriority ...interface{}) ([]byte, error) {
+	return api.SendAsyncContext(context.Background(), name, requestInfo, request, timeoutPriority...)
+}
+
+// SendAsyncContext sends an asynchronous service request with the timeout limited by the context deadline
+func (api *Instance) SendAsyncContext(ctx context.Context, name string, requestInfo, request []byte, timeoutPriority ...interface{}) ([]byte, error) {
+	options, err := sendOptionsVariadic(timeoutPriority)
+	if err != nil {
+		return nil, err
+	}
+	return api.SendAsyncOptions(ctx, name, requestInfo, request, options...)
+}
+
+// SendAsyncOptions sends an asynchronous service request with the timeout limited by the context deadline
+func (api *Instance) SendAsyncOptions(ctx context.Context, name string, requestInfo, request []byte, options ...SendOption) ([]byte, error) {
 	if name == "" {
-		return nil, invalidInputErrorNew()
+		return nil, invalidInputErrorNew("name")
 	}
 	if requestInfo == nil {
 		requestInfo = []byte{}
@@ -231,45 +344,68 @@ func (api *Instance) SendAsync(name string, requestInfo, request []byte, timeout
 	if request == nil {
 		request = []byte{}
 	}
-	extraArity := len(timeoutPriority)
-	if extraArity > 2 {
-		return nil, invalidInputErrorNew()
-	}
-	var err error
-	timeout := api.timeoutAsync
-	if extraArity > 0 {
-		timeout, err = timeoutCheck(timeoutPriority[0])
-		if err != nil {
-			return nil, err
-		}
-	}
-	priority := api.priorityDefault
-	if extraArity > 1 {
-		priority, err = priorityCheck(timeoutPriority[1])
-		if err != nil {
-			return nil, err
-		}
-	}
-	var sendAsync []byte
-	sendAsync, err = erlang.TermToBinary([]interface{}{erlang.OtpErlangAtom("send_async"), name, requestInfo, request, timeout, priority}, -1)
+	requestInfo = traceInfo(ctx, requestInfo)
+	send, err := api.sendOptionsNew(false, options)
 	if err != nil {
 		return nil, err
 	}
-	err = api.send(sendAsync)
+	start := time.Now()
+	var transId []byte
+	if send.retry != nil || send.breaker != nil {
+		_, transId, err = send.attempts(ctx, name, requestInfo, func(requestInfo []byte, send *sendOptions) (*Response, []byte, error) {
+			transId, err := api.sendAsync(ctx, name, requestInfo, request, send)
+			if err == nil && transIdNull(transId) {
+				// the service request timed out before it was sent
+				return &Response{}, transId, nil
+			}
+			return nil, transId, err
+		})
+	} else {
+		transId, err = api.sendAsync(ctx, name, requestInfo, request, send)
+	}
+	api.metricsGet().send(name, false, time.Since(start), err, transIdNull(transId))
 	if err != nil {
 		return nil, err
 	}
-	_, err = api.pollRequest(-1, false)
+	if send.timeoutError && transIdNull(transId) {
+		return nil, timeoutErrorNew(name, send.timeout)
+	}
+	return transId, nil
+}
+
+func (api *Instance) sendAsync(ctx context.Context, name string, requestInfo, request []byte, send *sendOptions) ([]byte, error) {
+	result, err := api.request(ctx, messageReturnAsync, func() ([]byte, error) {
+		timeout, err := timeoutContext(ctx, send.timeout)
+		if err != nil {
+			return nil, err
+		}
+		return erlang.TermToBinary([]interface{}{erlang.OtpErlangAtom("send_async"), name, requestInfo, request, timeout, send.priority}, -1)
+	})
 	if err != nil {
 		return nil, err
 	}
-	return api.transId, nil
+	return result.transId, nil
 }
 
 // SendSync sends a synchronous service request
+// (the timeout is not limited by a service request being handled, so use Request.SendSync within a Handler)
 func (api *Instance) SendSync(name string, requestInfo, request []byte, timeoutPriority ...interface{}) ([]byte, []byte, []byte, error) {
+	return api.SendSyncContext(context.Background(), name, requestInfo, request, timeoutPriority...)
+}
+
+// SendSyncContext sends a synchronous service request with the timeout limited by the context deadline
+func (api *Instance) SendSyncContext(ctx context.Context, name string, requestInfo, request []byte, timeoutPriority ...interface{}) ([]byte, []byte, []byte, error) {
+	options, err := sendOptionsVariadic(timeoutPriority)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return api.SendSyncOptions(ctx, name, requestInfo, request, options...)
+}
+
+// SendSyncOptions sends a synchronous service request with the timeout limited by the context deadline
+func (api *Instance) SendSyncOptions(ctx context.Context, name string, requestInfo, request []byte, options ...SendOption) ([]byte, []byte, []byte, error) {
 	if name == "" {
-		return nil, nil, nil, invalidInputErrorNew()
+		return nil, nil, nil, invalidInputErrorNew("name")
 	}
 	if requestInfo == nil {
 		requestInfo = []byte{}
@@ -277,45 +413,68 @@ func (api *Instance) SendSync(name string, requestInfo, request []byte, timeoutP
 	if request == nil {
 		request = []byte{}
 	}
-	extraArity := len(timeoutPriority)
-	if extraArity > 2 {
-		return nil, nil, nil, invalidInputErrorNew()
-	}
-	var err error
-	timeout := api.timeoutSync
-	if extraArity > 0 {
-		timeout, err = timeoutCheck(timeoutPriority[0])
-		if err != nil {
-			return nil, nil, nil, err
-		}
+	requestInfo = traceInfo(ctx, requestInfo)
+	send, err := api.sendOptionsNew(true, options)
+	if err != nil {
+		return nil, nil, nil, err
 	}
-	priority := api.priorityDefault
-	if extraArity > 1 {
-		priority, err = priorityCheck(timeoutPriority[1])
-		if err != nil {
-			return nil, nil, nil, err
+	start := time.Now()
+	var responseInfo, response, transId []byte
+	if send.retry != nil || send.breaker != nil {
+		var result *Response
+		result, transId, err = send.attempts(ctx, name, requestInfo, func(requestInfo []byte, send *sendOptions) (*Response, []byte, error) {
+			responseInfo, response, transId, err := api.sendSync(ctx, name, requestInfo, request, send)
+			return &Response{ResponseInfo: responseInfo, Response: response}, transId, err
+		})
+		if err == nil {
+			responseInfo, response = result.ResponseInfo, result.Response
 		}
+	} else {
+		responseInfo, response, transId, err = api.sendSync(ctx, name, requestInfo, request, send)
 	}
-	var sendSync []byte
-	sendSync, err = erlang.TermToBinary([]interface{}{erlang.OtpErlangAtom("send_sync"), name, requestInfo, request, timeout, priority}, -1)
+	api.metricsGet().send(name, true, time.Since(start), err, transIdNull(transId))
 	if err != nil {
 		return nil, nil, nil, err
 	}
-	err = api.send(sendSync)
-	if err != nil {
-		return nil, nil, nil, err
+	if send.timeoutError && transIdNull(transId) {
+		return nil, nil, nil, timeoutErrorNew(name, send.timeout)
 	}
-	_, err = api.pollRequest(-1, false)
+	return responseInfo, response, transId, nil
+}
+
+func (api *Instance) sendSync(ctx context.Context, name string, requestInfo, request []byte, send *sendOptions) ([]byte, []byte, []byte, error) {
+	result, err := api.request(ctx, messageReturnSync, func() ([]byte, error) {
+		timeout, err := timeoutContext(ctx, send.timeout)
+		if err != nil {
+			return nil, err
+		}
+		return erlang.TermToBinary([]interface{}{erlang.OtpErlangAtom("send_sync"), name, requestInfo, request, timeout, send.priority}, -1)
+	})
 	if err != nil {
 		return nil, nil, nil, err
 	}
-	return api.responseInfo, api.response, api.transId, nil
+	return result.responseInfo, result.response, result.transId, nil
 }
 
 // McastAsync sends asynchronous service requests to all subscribers of the matching service name pattern
+// (the timeout is not limited by a service request being handled, so use Request.McastAsync within a Handler)
 func (api *Instance) McastAsync(name string, requestInfo, request []byte, timeoutPriority ...interface{}) ([][]byte, error) {
+	return api.McastAsyncContext(context.Background(), name, requestInfo, request, timeoutPriority...)
+}
+
+// McastAsyncContext sends asynchronous service requests to all subscribers of the matching service name pattern with the timeout limited by the context deadline
+func (api *Instance) McastAsyncContext(ctx context.Context, name string, requestInfo, request []byte, timeoutPriority ...interface{}) ([][]byte, error) {
+	options, err := sendOptionsVariadic(timeoutPriority)
+	if err != nil {
+		return nil, err
+	}
+	return api.McastAsyncOptions(ctx, name, requestInfo, request, options...)
+}
+
+// McastAsyncOptions sends asynchronous service requests to all subscribers of the matching service name pattern with the timeout limited by the context deadline
+func (api *Instance) McastAsyncOptions(ctx context.Context, name string, requestInfo, request []byte, options ...SendOption) ([][]byte, error) {
 	if name == "" {
-		return nil, invalidInputErrorNew()
+		return nil, invalidInputErrorNew("name")
 	}
 	if requestInfo == nil {
 		requestInfo = []byte{}
@@ -323,48 +482,62 @@ func (api *Instance) McastAsync(name string, requestInfo, request []byte, timeou
 	if request == nil {
 		request = []byte{}
 	}
-	extraArity := len(timeoutPriority)
-	if extraArity > 2 {
-		return nil, invalidInputErrorNew()
-	}
-	var err error
-	timeout := api.timeoutAsync
-	if extraArity > 0 {
-		timeout, err = timeoutCheck(timeoutPriority[0])
-		if err != nil {
-			return nil, err
-		}
-	}
-	priority := api.priorityDefault
-	if extraArity > 1 {
-		priority, err = priorityCheck(timeoutPriority[1])
-		if err != nil {
-			return nil, err
-		}
-	}
-	var mcastAsync []byte
-	mcastAsync, err = erlang.TermToBinary([]interface{}{erlang.OtpErlangAtom("mcast_async"), name, requestInfo, request, timeout, priority}, -1)
+	requestInfo = traceInfo(ctx, requestInfo)
+	send, err := api.sendOptionsNew(false, options)
 	if err != nil {
 		return nil, err
 	}
-	err = api.send(mcastAsync)
+	start := time.Now()
+	var transIds [][]byte
+	if send.retry != nil || send.breaker != nil {
+		_, _, err = send.attempts(ctx, name, requestInfo, func(requestInfo []byte, send *sendOptions) (*Response, []byte, error) {
+			result, err := api.mcastAsync(ctx, name, requestInfo, request, send)
+			transIds = result
+			if err == nil && len(result) == 0 {
+				// no destinations were found before the timeout
+				return &Response{}, nil, nil
+			}
+			return nil, nil, err
+		})
+	} else {
+		transIds, err = api.mcastAsync(ctx, name, requestInfo, request, send)
+	}
+	api.metricsGet().send(name, false, time.Since(start), err, err == nil && len(transIds) == 0)
 	if err != nil {
 		return nil, err
 	}
-	_, err = api.pollRequest(-1, false)
+	if send.timeoutError && len(transIds) == 0 {
+		return nil, noDestinationErrorNew(name)
+	}
+	return transIds, nil
+}
+
+func (api *Instance) mcastAsync(ctx context.Context, name string, requestInfo, request []byte, send *sendOptions) ([][]byte, error) {
+	result, err := api.request(ctx, messageReturnsAsync, func() ([]byte, error) {
+		timeout, err := timeoutContext(ctx, send.timeout)
+		if err != nil {
+			return nil, err
+		}
+		return erlang.TermToBinary([]interface{}{erlang.OtpErlangAtom("mcast_async"), name, requestInfo, request, timeout, send.priority}, -1)
+	})
 	if err != nil {
 		return nil, err
 	}
-	return api.transIds, nil
+	return result.transIds, nil
 }
 
 func (api *Instance) forwardAsyncI(name string, requestInfo, request []byte, timeout uint32, priority int8, transId [16]byte, pid Source) error {
+	timeout, expired := api.activeTimeout(transId, timeout)
+	if expired != nil {
+		return api.returnAsyncI(expired.Name, expired.Pattern, nil, nil, expired.Timeout, transId, pid)
+	}
 	if requestInfo == nil {
 		requestInfo = []byte{}
 	}
 	if request == nil {
 		request = []byte{}
 	}
+	requestInfo = api.traceInfoForward(transId, requestInfo)
 	forwardAsync, err := erlang.TermToBinary([]interface{}{erlang.OtpErlangAtom("forward_async"), name, requestInfo, request, timeout, priority, transId[:], erlang.OtpErlangPid(pid)}, -1)
 	if err != nil {
 		return err
@@ -373,6 +546,7 @@ func (api *Instance) forwardAsyncI(name string, requestInfo, request []byte, tim
 	if err != nil {
 		return err
 	}
+	api.activeRemove(transId)
 	return nil
 }
 
@@ -380,18 +554,23 @@ func (api *Instance) forwardAsyncI(name string, requestInfo, request []byte, tim
 func (api *Instance) ForwardAsync(name string, requestInfo, request []byte, timeout uint32, priority int8, transId [16]byte, pid Source) {
 	err := api.forwardAsyncI(name, requestInfo, request, timeout, priority, transId, pid)
 	if err == nil {
-		err = forwardAsyncErrorNew()
+		err = forwardAsyncErrorNew(name)
 	}
 	panic(err)
 }
 
 func (api *Instance) forwardSyncI(name string, requestInfo, request []byte, timeout uint32, priority int8, transId [16]byte, pid Source) error {
+	timeout, expired := api.activeTimeout(transId, timeout)
+	if expired != nil {
+		return api.returnSyncI(expired.Name, expired.Pattern, nil, nil, expired.Timeout, transId, pid)
+	}
 	if requestInfo == nil {
 		requestInfo = []byte{}
 	}
 	if request == nil {
 		request = []byte{}
 	}
+	requestInfo = api.traceInfoForward(transId, requestInfo)
 	forwardSync, err := erlang.TermToBinary([]interface{}{erlang.OtpErlangAtom("forward_sync"), name, requestInfo, request, timeout, priority, transId[:], erlang.OtpErlangPid(pid)}, -1)
 	if err != nil {
 		return err
@@ -400,6 +579,7 @@ func (api *Instance) forwardSyncI(name string, requestInfo, request []byte, time
 	if err != nil {
 		return err
 	}
+	api.activeRemove(transId)
 	return nil
 }
 
@@ -407,7 +587,7 @@ func (api *Instance) forwardSyncI(name string, requestInfo, request []byte, time
 func (api *Instance) ForwardSync(name string, requestInfo, request []byte, timeout uint32, priority int8, transId [16]byte, pid Source) {
 	err := api.forwardSyncI(name, requestInfo, request, timeout, priority, transId, pid)
 	if err == nil {
-		err = forwardSyncErrorNew()
+		err = forwardSyncErrorNew(name)
 	}
 	panic(err)
 }
@@ -420,8 +600,29 @@ func (api *Instance) Forward(requestType int, name string, requestInfo, request
 	case SYNC:
 		api.ForwardSync(name, requestInfo, request, timeout, priority, transId, pid)
 	default:
-		panic(invalidInputErrorNew())
+		panic(invalidInputErrorNew("requestType"))
+	}
+}
+
+// ForwardTo forwards a service request to a different service name
+// and provides the result the callback must return (instead of a panic)
+func (api *Instance) ForwardTo(requestType int, name string, requestInfo, request []byte, timeout uint32, priority int8, transId [16]byte, pid Source) ([]byte, []byte, error) {
+	var err error
+	switch requestType {
+	case ASYNC:
+		err = api.forwardAsyncI(name, requestInfo, request, timeout, priority, transId, pid)
+		if err == nil {
+			err = forwardAsyncErrorNew(name)
+		}
+	case SYNC:
+		err = api.forwardSyncI(name, requestInfo, request, timeout, priority, transId, pid)
+		if err == nil {
+			err = forwardSyncErrorNew(name)
+		}
+	default:
+		err = invalidInputErrorNew("requestType")
 	}
+	return nil, nil, err
 }
 
 func (api *Instance) returnAsyncI(name, pattern string, responseInfo, response []byte, timeout uint32, transId [16]byte, pid Source) error {
@@ -439,6 +640,7 @@ func (api *Instance) returnAsyncI(name, pattern string, responseInfo, response [
 	if err != nil {
 		return err
 	}
+	api.activeRemove(transId)
 	return nil
 }
 
@@ -446,7 +648,7 @@ func (api *Instance) returnAsyncI(name, pattern string, responseInfo, response [
 func (api *Instance) ReturnAsync(name, pattern string, responseInfo, response []byte, timeout uint32, transId [16]byte, pid Source) {
 	err := api.returnAsyncI(name, pattern, responseInfo, response, timeout, transId, pid)
 	if err == nil {
-		err = returnAsyncErrorNew()
+		err = returnAsyncErrorNew(name, pattern)
 	}
 	panic(err)
 }
@@ -466,6 +668,7 @@ func (api *Instance) returnSyncI(name, pattern string, responseInfo, response []
 	if err != nil {
 		return err
 	}
+	api.activeRemove(transId)
 	return nil
 }
 
@@ -473,7 +676,7 @@ func (api *Instance) returnSyncI(name, pattern string, responseInfo, response []
 func (api *Instance) ReturnSync(name, pattern string, responseInfo, response []byte, timeout uint32, transId [16]byte, pid Source) {
 	err := api.returnSyncI(name, pattern, responseInfo, response, timeout, transId, pid)
 	if err == nil {
-		err = returnSyncErrorNew()
+		err = returnSyncErrorNew(name, pattern)
 	}
 	panic(err)
 }
@@ -486,19 +689,49 @@ func (api *Instance) Return(requestType int, name, pattern string, responseInfo,
 	case SYNC:
 		api.ReturnSync(name, pattern, responseInfo, response, timeout, transId, pid)
 	default:
-		panic(invalidInputErrorNew())
+		panic(invalidInputErrorNew("requestType"))
+	}
+}
+
+// Respond provides a response to a service request
+// and provides the result the callback must return (instead of a panic)
+func (api *Instance) Respond(requestType int, name, pattern string, responseInfo, response []byte, timeout uint32, transId [16]byte, pid Source) ([]byte, []byte, error) {
+	var err error
+	switch requestType {
+	case ASYNC:
+		err = api.returnAsyncI(name, pattern, responseInfo, response, timeout, transId, pid)
+		if err == nil {
+			err = returnAsyncErrorNew(name, pattern)
+		}
+	case SYNC:
+		err = api.returnSyncI(name, pattern, responseInfo, response, timeout, transId, pid)
+		if err == nil {
+			err = returnSyncErrorNew(name, pattern)
+		}
+	default:
+		err = invalidInputErrorNew("requestType")
 	}
+	return nil, nil, err
 }
 
 // RecvAsync blocks to receive an asynchronous service request response
 func (api *Instance) RecvAsync(extra ...interface{}) ([]byte, []byte, []byte, error) {
+	return api.RecvAsyncContext(context.Background(), extra...)
+}
+
+// RecvAsyncContext blocks to receive an asynchronous service request response with the timeout limited by the context deadline
+// (if the context is cancelled, the response may still be consumed)
+func (api *Instance) RecvAsyncContext(ctx context.Context, extra ...interface{}) ([]byte, []byte, []byte, error) {
 	extraArity := len(extra)
 	if extraArity > 3 {
-		return nil, nil, nil, invalidInputErrorNew()
+		return nil, nil, nil, invalidInputErrorNew("extra")
 	}
+	api.lock.RLock()
 	timeout := api.timeoutSync
+	api.lock.RUnlock()
 	var transId [16]byte
 	consume := true
+	timeoutError := false
 	for _, extraArg := range extra {
 		switch arg := extraArg.(type) {
 		case uint32:
@@ -509,102 +742,224 @@ func (api *Instance) RecvAsync(extra ...interface{}) ([]byte, []byte, []byte, er
 			timeout = uint32(arg)
 		case uint64:
 			if arg > math.MaxUint32 {
-				return nil, nil, nil, invalidInputErrorNew()
+				return nil, nil, nil, invalidInputErrorNew("timeout")
 			}
 			timeout = uint32(arg)
 		case int8:
 			if arg < 0 {
-				return nil, nil, nil, invalidInputErrorNew()
+				return nil, nil, nil, invalidInputErrorNew("timeout")
 			}
 			timeout = uint32(arg)
 		case int16:
 			if arg < 0 {
-				return nil, nil, nil, invalidInputErrorNew()
+				return nil, nil, nil, invalidInputErrorNew("timeout")
 			}
 			timeout = uint32(arg)
 		case int32:
 			if arg < 0 {
-				return nil, nil, nil, invalidInputErrorNew()
+				return nil, nil, nil, invalidInputErrorNew("timeout")
 			}
 			timeout = uint32(arg)
 		case int64:
 			if arg < 0 || arg > math.MaxUint32 {
-				return nil, nil, nil, invalidInputErrorNew()
+				return nil, nil, nil, invalidInputErrorNew("timeout")
 			}
 			timeout = uint32(arg)
 		case int:
 			if arg < 0 || uint64(arg) > math.MaxUint32 {
-				return nil, nil, nil, invalidInputErrorNew()
+				return nil, nil, nil, invalidInputErrorNew("timeout")
 			}
 			timeout = uint32(arg)
 		case [16]byte:
 			transId = arg
+		case TransId:
+			transId = arg
 		case []byte:
 			if len(arg) != 16 {
-				return nil, nil, nil, invalidInputErrorNew()
+				return nil, nil, nil, invalidInputErrorNew("transId")
 			}
 			copy(transId[:], arg)
 		case bool:
 			consume = arg
+		case SendOption:
+			// only the timeout options are accepted
+			recv := &sendOptions{timeout: timeout, recv: true}
+			if arg == nil || arg(recv) != nil {
+				return nil, nil, nil, invalidInputErrorNew("option")
+			}
+			timeout = recv.timeout
+			timeoutError = timeoutError || recv.timeoutError
 		default:
-			return nil, nil, nil, invalidInputErrorNew()
+			return nil, nil, nil, invalidInputErrorNew("extra")
 		}
 	}
-	recvAsync, err := erlang.TermToBinary([]interface{}{erlang.OtpErlangAtom("recv_async"), timeout, transId[:], consume}, -1)
+	err := api.closedCheck()
 	if err != nil {
 		return nil, nil, nil, err
 	}
-	err = api.send(recvAsync)
+	replyChan, release, err := api.recvAsyncAcquire(ctx, transId)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	timeout, err = timeoutContext(ctx, timeout)
+	var recvAsync []byte
+	if err == nil {
+		recvAsync, err = erlang.TermToBinary([]interface{}{erlang.OtpErlangAtom("recv_async"), timeout, transId[:], consume}, -1)
+	}
+	if err == nil {
+		err = api.send(recvAsync)
+	}
 	if err != nil {
+		release()
 		return nil, nil, nil, err
 	}
-	_, err = api.pollRequest(-1, false)
+	var result *reply
+	result, err = api.replyWait(ctx, replyChan, release)
 	if err != nil {
 		return nil, nil, nil, err
 	}
-	return api.responseInfo, api.response, api.transId, nil
+	if transIdNull(result.transId) ||
+		(len(result.responseInfo) == 0 && len(result.response) == 0) {
+		api.metricsGet().recvTimeout()
+		if timeoutError {
+			return nil, nil, nil, timeoutErrorNew("", timeout)
+		}
+	}
+	return result.responseInfo, result.response, result.transId, nil
+}
+
+// RecvAsyncsResult provides the responses received by RecvAsyncs
+type RecvAsyncsResult struct {
+	// Responses are keyed by trans id
+	Responses map[TransId]*Response
+	// Timeouts lists the trans ids without a response
+	Timeouts []TransId
+	// Uncollected lists the trans ids not received after count responses
+	// were received (a late response is discarded)
+	Uncollected []TransId
+}
+
+// RecvAsyncs blocks to receive the responses of many asynchronous service requests with a single timeout
+func (api *Instance) RecvAsyncs(transIds [][]byte, timeout uint32) (*RecvAsyncsResult, error) {
+	return api.RecvAsyncsContext(context.Background(), transIds, timeout, len(transIds))
+}
+
+// RecvAsyncsContext blocks to receive the responses of many asynchronous service requests with a single timeout limited by the context deadline.
+// Only count responses are received (e.g., 1 to receive any response) and the other trans ids are provided as Uncollected (any other response is discarded).
+// An empty response is treated as a timeout.
+func (api *Instance) RecvAsyncsContext(ctx context.Context, transIds [][]byte, timeout uint32, count int) (*RecvAsyncsResult, error) {
+	pending := make([]TransId, 0, len(transIds))
+	unique := map[TransId]bool{}
+	for _, transIdValue := range transIds {
+		transId, err := TransIdNew(transIdValue)
+		if err != nil || transId.IsZero() {
+			return nil, invalidInputErrorNew("transIds")
+		}
+		if !unique[transId] {
+			unique[transId] = true
+			pending = append(pending, transId)
+		}
+	}
+	if len(pending) == 0 {
+		return &RecvAsyncsResult{Responses: map[TransId]*Response{}}, nil
+	}
+	if count < 1 || count > len(pending) {
+		return nil, invalidInputErrorNew("count")
+	}
+	ctxRecv, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Millisecond)
+	defer cancel()
+	type recvAsyncsReply struct {
+		transId  TransId
+		response *Response
+		err      error
+	}
+	replies := make(chan recvAsyncsReply, len(pending))
+	for _, transId := range pending {
+		go func(transId TransId) {
+			responseInfo, response, _, err := api.RecvAsyncContext(ctxRecv, timeout, transId)
+			if err == nil && (len(responseInfo) > 0 || len(response) > 0) {
+				replies <- recvAsyncsReply{transId: transId, response: &Response{ResponseInfo: responseInfo, Response: response}}
+				return
+			}
+			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+				if ctx.Err() == nil && errors.Is(ctxRecv.Err(), context.DeadlineExceeded) {
+					// the RecvAsyncs timeout
+					api.metricsGet().recvTimeout()
+				}
+				err = nil
+			}
+			replies <- recvAsyncsReply{transId: transId, err: err}
+		}(transId)
+	}
+	result := &RecvAsyncsResult{Responses: map[TransId]*Response{}}
+	var err error
+	for range pending {
+		value := <-replies
+		if value.err != nil && err == nil {
+			err = value.err
+		}
+		if len(result.Responses) == count {
+			result.Uncollected = append(result.Uncollected, value.transId)
+		} else if value.response != nil {
+			result.Responses[value.transId] = value.response
+			if len(result.Responses) == count {
+				cancel()
+			}
+		} else {
+			result.Timeouts = append(result.Timeouts, value.transId)
+		}
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		return result, err
+	}
+	return result, nil
 }
 
 func timeoutCheck(value interface{}) (uint32, error) {
 	switch timeout := value.(type) {
 	case uint32:
 		return timeout, nil
+	case time.Duration:
+		return timeoutDuration(timeout)
 	case uint8:
 		return uint32(timeout), nil
 	case uint16:
 		return uint32(timeout), nil
 	case uint64:
 		if timeout > math.MaxUint32 {
-			return 0, invalidInputErrorNew()
+			return 0, invalidInputErrorNew("timeout")
 		}
 		return uint32(timeout), nil
 	case int8:
 		if timeout < 0 {
-			return 0, invalidInputErrorNew()
+			return 0, invalidInputErrorNew("timeout")
 		}
 		return uint32(timeout), nil
 	case int16:
 		if timeout < 0 {
-			return 0, invalidInputErrorNew()
+			return 0, invalidInputErrorNew("timeout")
 		}
 		return uint32(timeout), nil
 	case int32:
 		if timeout < 0 {
-			return 0, invalidInputErrorNew()
+			return 0, invalidInputErrorNew("timeout")
 		}
 		return uint32(timeout), nil
 	case int64:
 		if timeout < 0 || timeout > math.MaxUint32 {
-			return 0, invalidInputErrorNew()
+			return 0, invalidInputErrorNew("timeout")
 		}
 		return uint32(timeout), nil
 	case int:
 		if timeout < 0 || uint64(timeout) > math.MaxUint32 {
-			return 0, invalidInputErrorNew()
+			return 0, invalidInputErrorNew("timeout")
 		}
 		return uint32(timeout), nil
 	default:
-		return 0, invalidInputErrorNew()
+		return 0, invalidInputErrorNew("timeout")
 	}
 }
 
@@ -612,51 +967,58 @@ func priorityCheck(value interface{}) (int8, error) {
 	switch priority := value.(type) {
 	case int8:
 		return priority, nil
+	case Priority:
+		return int8(priority), nil
 	case uint8:
 		if priority > math.MaxInt8 {
-			return 0, invalidInputErrorNew()
+			return 0, invalidInputErrorNew("priority")
 		}
 		return int8(priority), nil
 	case uint16:
 		if priority > math.MaxInt8 {
-			return 0, invalidInputErrorNew()
+			return 0, invalidInputErrorNew("priority")
 		}
 		return int8(priority), nil
 	case uint32:
 		if priority > math.MaxInt8 {
-			return 0, invalidInputErrorNew()
+			return 0, invalidInputErrorNew("priority")
 		}
 		return int8(priority), nil
 	case uint64:
 		if priority > math.MaxInt8 {
-			return 0, invalidInputErrorNew()
+			return 0, invalidInputErrorNew("priority")
 		}
 		return int8(priority), nil
 	case int16:
-		if priority < math.MaxInt8 || priority > math.MaxInt8 {
-			return 0, invalidInputErrorNew()
+		if priority < math.MinInt8 || priority > math.MaxInt8 {
+			return 0, invalidInputErrorNew("priority")
 		}
 		return int8(priority), nil
 	case int32:
-		if priority < math.MaxInt8 || priority > math.MaxInt8 {
-			return 0, invalidInputErrorNew()
+		if priority < math.MinInt8 || priority > math.MaxInt8 {
+			return 0, invalidInputErrorNew("priority")
 		}
 		return int8(priority), nil
 	case int64:
-		if priority < math.MaxInt8 || priority > math.MaxInt8 {
-			return 0, invalidInputErrorNew()
+		if priority < math.MinInt8 || priority > math.MaxInt8 {
+			return 0, invalidInputErrorNew("priority")
 		}
 		return int8(priority), nil
 	case int:
-		if priority < math.MaxInt8 || priority > math.MaxInt8 {
-			return 0, invalidInputErrorNew()
+		if priority < math.MinInt8 || priority > math.MaxInt8 {
+			return 0, invalidInputErrorNew("priority")
 		}
 		return int8(priority), nil
 	default:
-		return 0, invalidInputErrorNew()
+		return 0, invalidInputErrorNew("priority")
 	}
 }
 
+// ThreadIndex returns the 0-based index of the thread used to create this instance
+func (api *Instance) ThreadIndex() uint32 {
+	return api.threadIndex
+}
+
 // ProcessIndex returns the 0-based index of this process in the service instance
 func (api *Instance) ProcessIndex() uint32 {
 	return api.processIndex
@@ -664,6 +1026,8 @@ func (api *Instance) ProcessIndex() uint32 {
 
 // ProcessCount returns the current process count based on the service configuration
 func (api *Instance) ProcessCount() uint32 {
+	api.lock.RLock()
+	defer api.lock.RUnlock()
 	return api.processCount
 }
 
@@ -689,11 +1053,15 @@ func (api *Instance) TimeoutInitialize() uint32 {
 
 // TimeoutAsync returns the default asynchronous service request send timeout from the service configuration
 func (api *Instance) TimeoutAsync() uint32 {
+	api.lock.RLock()
+	defer api.lock.RUnlock()
 	return api.timeoutAsync
 }
 
 // TimeoutSync returns the default synchronous service request send timeout from the service configuration
 func (api *Instance) TimeoutSync() uint32 {
+	api.lock.RLock()
+	defer api.lock.RUnlock()
 	return api.timeoutSync
 }
 
@@ -702,72 +1070,82 @@ func (api *Instance) TimeoutTerminate() uint32 {
 	return api.timeoutTerminate
 }
 
-func (api *Instance) callback(command uint32, name, pattern string, requestInfo, request []byte, timeout uint32, priority int8, transId [16]byte, pid Source) error {
-	functionQueue := api.callbacks[pattern]
-	var function Callback
+func (api *Instance) callback(request *Request) error {
+	api.callbacksLock.Lock()
+	functionQueue := api.callbacks[request.Pattern]
+	var function Handler
 	if functionQueue == nil {
-		function = nullResponse
+		function = Callback(nullResponse)
 	} else {
-		function = functionQueue.Remove(functionQueue.Front()).(Callback)
+		function = functionQueue.Remove(functionQueue.Front()).(Handler)
 		_ = functionQueue.PushBack(function)
 	}
-	switch command {
-	case messageSendAsync:
-		responseInfo, response, err := api.callbackExecute(function, command, name, pattern, requestInfo, request, timeout, priority, transId, pid)
+	api.callbacksLock.Unlock()
+	api.traceStart(request)
+	api.activeAdd(request)
+	switch request.RequestType {
+	case ASYNC:
+		responseInfo, response, err := api.callbackExecute(function, request)
 		if err != nil {
-			switch err.(type) {
-			case *MessageDecodingError:
-				api.terminate = true
+			switch {
+			case errors.Is(err, ErrMessageDecoding):
+				api.terminateSet()
 				err = nil
-			case *TerminateError:
+			case errors.Is(err, ErrTerminate):
 				err = nil
-			case *ReturnAsyncError:
+			case errors.Is(err, ErrReturnAsync):
 				return nil
-			case *ReturnSyncError:
-				api.terminate = true
+			case errors.Is(err, ErrReturnSync):
+				api.terminateSet()
 				return err
-			case *ForwardAsyncError:
+			case errors.Is(err, ErrForwardAsync):
 				return nil
-			case *ForwardSyncError:
-				api.terminate = true
+			case errors.Is(err, ErrForwardSync):
+				api.terminateSet()
 				return err
+			case errors.Is(err, ErrDeferred):
+				return nil
 			default:
 				os.Stderr.WriteString(err.Error() + "\n")
 				err = nil
 			}
 		}
-		return api.returnAsyncI(name, pattern, responseInfo, response, timeout, transId, pid)
-	case messageSendSync:
-		responseInfo, response, err := api.callbackExecute(function, command, name, pattern, requestInfo, request, timeout, priority, transId, pid)
+		return api.returnAsyncI(request.Name, request.Pattern, responseInfo, response, request.Timeout, request.TransId, request.Source)
+	case SYNC:
+		responseInfo, response, err := api.callbackExecute(function, request)
 		if err != nil {
-			switch err.(type) {
-			case *MessageDecodingError:
-				api.terminate = true
+			switch {
+			case errors.Is(err, ErrMessageDecoding):
+				api.terminateSet()
 				err = nil
-			case *TerminateError:
+			case errors.Is(err, ErrTerminate):
 				err = nil
-			case *ReturnAsyncError:
-				api.terminate = true
+			case errors.Is(err, ErrReturnAsync):
+				api.terminateSet()
 				return err
-			case *ReturnSyncError:
+			case errors.Is(err, ErrReturnSync):
 				return nil
-			case *ForwardAsyncError:
-				api.terminate = true
+			case errors.Is(err, ErrForwardAsync):
+				api.terminateSet()
 				return err
-			case *ForwardSyncError:
+			case errors.Is(err, ErrForwardSync):
+				return nil
+			case errors.Is(err, ErrDeferred):
 				return nil
 			default:
 				os.Stderr.WriteString(err.Error() + "\n")
 				err = nil
 			}
 		}
-		return api.returnSyncI(name, pattern, responseInfo, response, timeout, transId, pid)
+		return api.returnSyncI(request.Name, request.Pattern, responseInfo, response, request.Timeout, request.TransId, request.Source)
 	default:
-		return messageDecodingErrorNew()
+		return messageDecodingErrorNew(0, "requestType", 0, nil)
 	}
 }
 
-func (api *Instance) callbackExecute(function Callback, command uint32, name, pattern string, requestInfo, request []byte, timeout uint32, priority int8, transId [16]byte, pid Source) (responseInfo []byte, response []byte, err error) {
+func (api *Instance) callbackExecute(function Handler, request *Request) (responseInfo []byte, response []byte, err error) {
+	start := time.Now()
+	panicked := false
 	defer func() {
 		if r := recover(); r != nil {
 			switch errValue := r.(type) {
@@ -787,424 +1165,648 @@ func (api *Instance) callbackExecute(function Callback, command uint32, name, pa
 				err = errValue
 			default:
 				err = StackErrorWrapNew(errValue)
+				panicked = true
 			}
 		}
+		if request.responder != nil && !errors.Is(err, ErrDeferred) &&
+			request.responder.respond() != nil {
+			// the Responder already provided the response
+			err = deferredErrorNew()
+		}
+		api.metricsGet().request(request, time.Since(start), err, panicked)
+		api.traceEnd(request, err)
 	}()
-	switch command {
-	case messageSendAsync:
-		responseInfo, response, err = function(ASYNC, name, pattern, requestInfo, request, timeout, priority, transId, pid, api.state, api)
-	case messageSendSync:
-		responseInfo, response, err = function(SYNC, name, pattern, requestInfo, request, timeout, priority, transId, pid, api.state, api)
+	var result *Response
+	result, err = function.ServeCloudI(request)
+	if result != nil {
+		responseInfo = result.ResponseInfo
+		response = result.Response
 	}
 	return
 }
 
-func (api *Instance) handleEvents(external bool, reader *bytes.Reader, command uint32) (bool, error) {
+// handlerError returns true if the Handler error was not
+// a Return, Forward or a Responder being used
+func handlerError(err error) bool {
+	return err != nil &&
+		!errors.Is(err, ErrReturnAsync) && !errors.Is(err, ErrReturnSync) &&
+		!errors.Is(err, ErrForwardAsync) && !errors.Is(err, ErrForwardSync) &&
+		!errors.Is(err, ErrDeferred) && !errors.Is(err, ErrTerminate)
+}
+
+func (api *Instance) handleEvents(reader *bytes.Reader, command uint32) error {
 	var err error
 	if command == 0 {
-		err = binary.Read(reader, nativeEndian, &command)
+		err = messageRead(reader, command, "command", &command)
 		if err != nil {
-			return true, err
+			return err
 		}
 	}
 	for true {
 		switch command {
 		case messageTerm:
-			api.terminate = true
-			if external {
-				return false, nil
-			}
-			return true, terminateErrorNew(api.timeoutTerminate)
+			api.terminateSet()
 		case messageReinit:
-			err = binary.Read(reader, nativeEndian, &(api.processCount))
+			var processCount, timeoutAsync, timeoutSync uint32
+			var priorityDefault int8
+			err = messageRead(reader, command, "processCount", &processCount)
 			if err != nil {
-				return true, err
+				return err
 			}
-			err = binary.Read(reader, nativeEndian, &(api.timeoutAsync))
+			err = messageRead(reader, command, "timeoutAsync", &timeoutAsync)
 			if err != nil {
-				return false, err
+				return err
 			}
-			err = binary.Read(reader, nativeEndian, &(api.timeoutSync))
+			err = messageRead(reader, command, "timeoutSync", &timeoutSync)
 			if err != nil {
-				return false, err
+				return err
 			}
-			err = binary.Read(reader, nativeEndian, &(api.priorityDefault))
+			err = messageRead(reader, command, "priorityDefault", &priorityDefault)
 			if err != nil {
-				return false, err
+				return err
 			}
+			api.lock.Lock()
+			api.processCount = processCount
+			api.timeoutAsync = timeoutAsync
+			api.timeoutSync = timeoutSync
+			api.priorityDefault = priorityDefault
+			api.lock.Unlock()
 		case messageKeepalive:
 			var keepalive []byte
 			keepalive, err = erlang.TermToBinary(erlang.OtpErlangAtom("keepalive"), -1)
 			if err != nil {
-				return true, err
+				return err
 			}
 			err = api.send(keepalive)
 			if err != nil {
-				return true, err
+				return err
 			}
 		default:
-			return true, messageDecodingErrorNew()
+			return messageDecodingErrorNew(command, "command", reader.Size()-int64(reader.Len())-4, nil)
 		}
 		if reader.Len() == 0 {
-			return true, nil
+			return nil
 		}
-		err = binary.Read(reader, nativeEndian, &command)
+		err = messageRead(reader, command, "command", &command)
 		if err != nil {
-			return true, err
+			return err
 		}
 	}
-	return true, nil
+	return nil
 }
 
-func (api *Instance) pollRequest(timeout int32, external bool) (bool, error) {
-	var err error
-	if api.terminate {
-		if external {
-			return false, nil
-		}
-		return true, terminateErrorNew(api.timeoutTerminate)
-	} else if external && !api.initializationComplete {
-		var polling []byte
-		polling, err = erlang.TermToBinary(erlang.OtpErlangAtom("polling"), -1)
-		if err != nil {
-			return false, err
+// recvLoop receives all CloudI messages for the Instance,
+// providing each reply to the goroutine waiting for it
+// and queuing each service request for Poll
+func (api *Instance) recvLoop() {
+	for true {
+		data, err := api.recv()
+		if err == nil {
+			err = api.handleMessage(data)
 		}
-		err = api.send(polling)
 		if err != nil {
-			return false, err
+			api.errRecv = err
+			close(api.closed)
+			return
 		}
-		api.initializationComplete = true
 	}
-	pollTimer := time.Now()
-	var pollTimerDeadline time.Time
-	if timeout == 0 {
-		pollTimerDeadline = pollTimer.Add(time.Duration(500) * time.Microsecond)
-	} else if timeout > 0 {
-		pollTimerDeadline = pollTimer.Add(time.Duration(timeout) * time.Millisecond)
+}
+
+func (api *Instance) handleMessage(data []byte) error {
+	reader := bytes.NewReader(data)
+	var command uint32
+	err := messageRead(reader, command, "command", &command)
+	if err != nil {
+		return err
 	}
-	for true {
-		err = api.socket.SetReadDeadline(pollTimerDeadline)
+	switch command {
+	case messageInit:
+		err = messageRead(reader, command, "processIndex", &(api.processIndex))
 		if err != nil {
-			return false, err
+			return err
 		}
-		var data []byte
-		data, err = api.recv()
+		err = messageRead(reader, command, "processCount", &(api.processCount))
 		if err != nil {
-			switch errNet := err.(type) {
-			case *net.OpError:
-				if errNet.Timeout() {
-					return true, nil
-				}
-			default:
-				return false, err
-			}
+			return err
 		}
-		reader := bytes.NewReader(data)
-		var command uint32
-		err = binary.Read(reader, nativeEndian, &command)
+		err = messageRead(reader, command, "processCountMax", &(api.processCountMax))
 		if err != nil {
-			return false, err
+			return err
 		}
-		switch command {
-		case messageInit:
-			err = binary.Read(reader, nativeEndian, &(api.processIndex))
-			if err != nil {
-				return false, err
-			}
-			err = binary.Read(reader, nativeEndian, &(api.processCount))
-			if err != nil {
-				return false, err
-			}
-			err = binary.Read(reader, nativeEndian, &(api.processCountMax))
-			if err != nil {
-				return false, err
-			}
-			err = binary.Read(reader, nativeEndian, &(api.processCountMin))
-			if err != nil {
-				return false, err
-			}
-			var prefixSize uint32
-			err = binary.Read(reader, nativeEndian, &prefixSize)
-			if err != nil {
-				return false, err
-			}
-			prefix := make([]byte, prefixSize-1)
-			_, err = reader.Read(prefix)
-			if err != nil {
-				return false, err
-			}
-			api.prefix = string(prefix)
-			_, err = reader.ReadByte() // null terminator
-			if err != nil {
-				return false, err
-			}
-			err = binary.Read(reader, nativeEndian, &(api.timeoutInitialize))
-			if err != nil {
-				return false, err
-			}
-			err = binary.Read(reader, nativeEndian, &(api.timeoutAsync))
-			if err != nil {
-				return false, err
-			}
-			err = binary.Read(reader, nativeEndian, &(api.timeoutSync))
-			if err != nil {
-				return false, err
-			}
-			err = binary.Read(reader, nativeEndian, &(api.timeoutTerminate))
-			if err != nil {
-				return false, err
-			}
-			err = binary.Read(reader, nativeEndian, &(api.priorityDefault))
-			if err != nil {
-				return false, err
-			}
-			if reader.Len() > 0 {
-				_, err = api.handleEvents(external, reader, 0)
-				if err != nil {
-					return false, err
-				}
-			}
-			return false, nil
-		case messageSendAsync:
-			fallthrough
-		case messageSendSync:
-			var nameSize uint32
-			err = binary.Read(reader, nativeEndian, &nameSize)
-			if err != nil {
-				return false, err
-			}
-			name := make([]byte, nameSize-1)
-			_, err = reader.Read(name)
-			if err != nil {
-				return false, err
-			}
-			_, err = reader.ReadByte() // null terminator
-			if err != nil {
-				return false, err
-			}
-			var patternSize uint32
-			err = binary.Read(reader, nativeEndian, &patternSize)
-			if err != nil {
-				return false, err
-			}
-			pattern := make([]byte, patternSize-1)
-			_, err = reader.Read(pattern)
-			if err != nil {
-				return false, err
-			}
-			_, err = reader.ReadByte() // null terminator
-			if err != nil {
-				return false, err
-			}
-			var requestInfoSize uint32
-			err = binary.Read(reader, nativeEndian, &requestInfoSize)
-			if err != nil {
-				return false, err
-			}
-			requestInfo := make([]byte, requestInfoSize)
-			_, err = reader.Read(requestInfo)
-			if err != nil {
-				return false, err
-			}
-			_, err = reader.ReadByte() // null terminator
-			if err != nil {
-				return false, err
-			}
-			var requestSize uint32
-			err = binary.Read(reader, nativeEndian, &requestSize)
-			if err != nil {
-				return false, err
-			}
-			request := make([]byte, requestSize)
-			_, err = reader.Read(request)
-			if err != nil {
-				return false, err
-			}
-			_, err = reader.ReadByte() // null terminator
-			if err != nil {
-				return false, err
-			}
-			var requestTimeout uint32
-			err = binary.Read(reader, nativeEndian, &requestTimeout)
-			if err != nil {
-				return false, err
-			}
-			var priority int8
-			err = binary.Read(reader, nativeEndian, &priority)
-			if err != nil {
-				return false, err
-			}
-			var transId [16]byte
-			_, err = reader.Read(transId[:])
-			if err != nil {
-				return false, err
-			}
-			var pidSize uint32
-			err = binary.Read(reader, nativeEndian, &pidSize)
-			if err != nil {
-				return false, err
-			}
-			pidBinary := make([]byte, pidSize)
-			_, err = reader.Read(pidBinary)
-			if err != nil {
-				return false, err
-			}
-			var pid interface{}
-			pid, err = erlang.BinaryToTerm(pidBinary)
-			if err != nil {
-				return false, err
-			}
-			if reader.Len() > 0 {
-				var handled bool
-				handled, err = api.handleEvents(external, reader, 0)
-				if err != nil {
-					return false, err
-				}
-				if !handled {
-					return false, nil
-				}
-			}
-			err = api.callback(command, string(name), string(pattern), requestInfo, request, requestTimeout, priority, transId, Source(pid.(erlang.OtpErlangPid)))
-			if err != nil {
-				return false, err
-			}
-			if api.terminate {
-				return false, nil
-			}
-		case messageRecvAsync:
-			fallthrough
-		case messageReturnSync:
-			var responseInfoSize uint32
-			err = binary.Read(reader, nativeEndian, &responseInfoSize)
-			if err != nil {
-				return false, err
-			}
-			responseInfo := make([]byte, responseInfoSize)
-			_, err = reader.Read(responseInfo)
-			if err != nil {
-				return false, err
-			}
-			_, err = reader.ReadByte() // null terminator
+		err = messageRead(reader, command, "processCountMin", &(api.processCountMin))
+		if err != nil {
+			return err
+		}
+		var prefixSize uint32
+		err = messageRead(reader, command, "prefixSize", &prefixSize)
+		if err != nil {
+			return err
+		}
+		var prefix []byte
+		prefix, err = messageReadBinary(reader, command, "prefix", prefixSize-1)
+		if err != nil {
+			return err
+		}
+		api.prefix = string(prefix)
+		err = messageRead(reader, command, "timeoutInitialize", &(api.timeoutInitialize))
+		if err != nil {
+			return err
+		}
+		err = messageRead(reader, command, "timeoutAsync", &(api.timeoutAsync))
+		if err != nil {
+			return err
+		}
+		err = messageRead(reader, command, "timeoutSync", &(api.timeoutSync))
+		if err != nil {
+			return err
+		}
+		err = messageRead(reader, command, "timeoutTerminate", &(api.timeoutTerminate))
+		if err != nil {
+			return err
+		}
+		err = messageRead(reader, command, "priorityDefault", &(api.priorityDefault))
+		if err != nil {
+			return err
+		}
+		if reader.Len() > 0 {
+			err = api.handleEvents(reader, 0)
 			if err != nil {
-				return false, err
+				return err
 			}
-			var responseSize uint32
-			err = binary.Read(reader, nativeEndian, &responseSize)
+		}
+		api.replies[command].provide(&reply{})
+	case messageSendAsync:
+		fallthrough
+	case messageSendSync:
+		var nameSize uint32
+		err = messageRead(reader, command, "nameSize", &nameSize)
+		if err != nil {
+			return err
+		}
+		var name []byte
+		name, err = messageReadBinary(reader, command, "name", nameSize-1)
+		if err != nil {
+			return err
+		}
+		var patternSize uint32
+		err = messageRead(reader, command, "patternSize", &patternSize)
+		if err != nil {
+			return err
+		}
+		var pattern []byte
+		pattern, err = messageReadBinary(reader, command, "pattern", patternSize-1)
+		if err != nil {
+			return err
+		}
+		var requestInfoSize uint32
+		err = messageRead(reader, command, "requestInfoSize", &requestInfoSize)
+		if err != nil {
+			return err
+		}
+		var requestInfo []byte
+		requestInfo, err = messageReadBinary(reader, command, "requestInfo", requestInfoSize)
+		if err != nil {
+			return err
+		}
+		var requestSize uint32
+		err = messageRead(reader, command, "requestSize", &requestSize)
+		if err != nil {
+			return err
+		}
+		var request []byte
+		request, err = messageReadBinary(reader, command, "request", requestSize)
+		if err != nil {
+			return err
+		}
+		var requestTimeout uint32
+		err = messageRead(reader, command, "requestTimeout", &requestTimeout)
+		if err != nil {
+			return err
+		}
+		var priority int8
+		err = messageRead(reader, command, "priority", &priority)
+		if err != nil {
+			return err
+		}
+		var transId [16]byte
+		err = messageRead(reader, command, "transId", transId[:])
+		if err != nil {
+			return err
+		}
+		var pidSize uint32
+		err = messageRead(reader, command, "pidSize", &pidSize)
+		if err != nil {
+			return err
+		}
+		pidBinary := make([]byte, pidSize)
+		err = messageRead(reader, command, "pid", pidBinary)
+		if err != nil {
+			return err
+		}
+		var pid interface{}
+		pid, err = erlang.BinaryToTerm(pidBinary)
+		if err != nil {
+			return err
+		}
+		if reader.Len() > 0 {
+			err = api.handleEvents(reader, 0)
 			if err != nil {
-				return false, err
+				return err
 			}
-			response := make([]byte, responseSize)
-			_, err = reader.Read(response)
+		}
+		requestType := ASYNC
+		if command == messageSendSync {
+			requestType = SYNC
+		}
+		api.requestsPush(&Request{RequestType: requestType, Name: string(name), Pattern: string(pattern), RequestInfo: requestInfo, Request: request, Timeout: requestTimeout, Priority: priority, TransId: transId, Source: Source(pid.(erlang.OtpErlangPid)), state: api.state, api: api, deadline: time.Now().Add(time.Duration(requestTimeout) * time.Millisecond)})
+	case messageRecvAsync:
+		fallthrough
+	case messageReturnSync:
+		var responseInfoSize uint32
+		err = messageRead(reader, command, "responseInfoSize", &responseInfoSize)
+		if err != nil {
+			return err
+		}
+		var responseInfo []byte
+		responseInfo, err = messageReadBinary(reader, command, "responseInfo", responseInfoSize)
+		if err != nil {
+			return err
+		}
+		var responseSize uint32
+		err = messageRead(reader, command, "responseSize", &responseSize)
+		if err != nil {
+			return err
+		}
+		var response []byte
+		response, err = messageReadBinary(reader, command, "response", responseSize)
+		if err != nil {
+			return err
+		}
+		transId := make([]byte, 16)
+		err = messageRead(reader, command, "transId", transId)
+		if err != nil {
+			return err
+		}
+		if reader.Len() > 0 {
+			err = api.handleEvents(reader, 0)
 			if err != nil {
-				return false, err
+				return err
 			}
-			_, err = reader.ReadByte() // null terminator
+		}
+		result := &reply{responseInfo: responseInfo, response: response, transId: transId}
+		if command == messageRecvAsync {
+			api.recvAsyncReply(result)
+		} else {
+			api.replies[command].provide(result)
+		}
+	case messageReturnAsync:
+		transId := make([]byte, 16)
+		err = messageRead(reader, command, "transId", transId)
+		if err != nil {
+			return err
+		}
+		if reader.Len() > 0 {
+			err = api.handleEvents(reader, 0)
 			if err != nil {
-				return false, err
+				return err
 			}
+		}
+		api.replies[command].provide(&reply{transId: transId})
+	case messageReturnsAsync:
+		var transIdCount uint32
+		err = messageRead(reader, command, "transIdCount", &transIdCount)
+		if err != nil {
+			return err
+		}
+		transIds := make([][]byte, transIdCount)
+		for i := uint32(0); i < transIdCount; i++ {
 			transId := make([]byte, 16)
-			_, err = reader.Read(transId)
+			err = messageRead(reader, command, "transId", transId)
 			if err != nil {
-				return false, err
-			}
-			if reader.Len() > 0 {
-				_, err = api.handleEvents(external, reader, 0)
-				if err != nil {
-					return false, err
-				}
+				return err
 			}
-			api.responseInfo = responseInfo
-			api.response = response
-			api.transId = transId
-			return false, nil
-		case messageReturnAsync:
-			transId := make([]byte, 16)
-			_, err = reader.Read(transId)
+			transIds[i] = transId
+		}
+		if reader.Len() > 0 {
+			err = api.handleEvents(reader, 0)
 			if err != nil {
-				return false, err
-			}
-			if reader.Len() > 0 {
-				_, err = api.handleEvents(external, reader, 0)
-				if err != nil {
-					return false, err
-				}
+				return err
 			}
-			api.transId = transId
-			return false, nil
-		case messageReturnsAsync:
-			var transIdCount uint32
-			err = binary.Read(reader, nativeEndian, &transIdCount)
+		}
+		api.replies[command].provide(&reply{transIds: transIds})
+	case messageSubscribeCount:
+		var subscribeCount uint32
+		err = messageRead(reader, command, "subscribeCount", &subscribeCount)
+		if err != nil {
+			return err
+		}
+		if reader.Len() > 0 {
+			err = api.handleEvents(reader, 0)
 			if err != nil {
-				return false, err
-			}
-			transIds := make([][]byte, transIdCount)
-			for i := uint32(0); i < transIdCount; i++ {
-				transId := make([]byte, 16)
-				_, err = reader.Read(transId)
-				if err != nil {
-					return false, err
-				}
-				transIds[i] = transId
-			}
-			if reader.Len() > 0 {
-				_, err = api.handleEvents(external, reader, 0)
-				if err != nil {
-					return false, err
-				}
+				return err
 			}
-			api.transIds = transIds
+		}
+		api.replies[command].provide(&reply{subscribeCount: subscribeCount})
+	case messageTerm, messageReinit, messageKeepalive:
+		return api.handleEvents(reader, command)
+	default:
+		return messageDecodingErrorNew(command, "command", 0, nil)
+	}
+	return nil
+}
+
+// messageRead decodes a fixed size field of a CloudI message
+func messageRead(reader *bytes.Reader, command uint32, field string, value interface{}) error {
+	offset := reader.Size() - int64(reader.Len())
+	err := binary.Read(reader, nativeEndian, value)
+	if err != nil {
+		return messageDecodingErrorNew(command, field, offset, err)
+	}
+	return nil
+}
+
+// messageReadBinary decodes a null terminated binary field of a CloudI message
+func messageReadBinary(reader *bytes.Reader, command uint32, field string, size uint32) ([]byte, error) {
+	if int64(size) >= int64(reader.Len()) {
+		offset := reader.Size() - int64(reader.Len())
+		return nil, messageDecodingErrorNew(command, field, offset, io.ErrUnexpectedEOF)
+	}
+	value := make([]byte, size)
+	err := messageRead(reader, command, field, value)
+	if err != nil {
+		return nil, err
+	}
+	var null byte
+	err = messageRead(reader, command, field, &null)
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// reply is the data the CloudI core provides in reply to a request
+type reply struct {
+	responseInfo   []byte
+	response       []byte
+	transId        []byte
+	transIds       [][]byte
+	subscribeCount uint32
+}
+
+// replySlot allows a single request to wait for each type of reply,
+// since the reply contains no data to associate it with the request
+type replySlot struct {
+	token chan struct{}
+	reply chan *reply
+}
+
+func replySlotNew() *replySlot {
+	return &replySlot{token: make(chan struct{}, 1), reply: make(chan *reply, 1)}
+}
+
+func (slot *replySlot) provide(result *reply) {
+	replyProvide(slot.reply, result)
+}
+
+// replyProvide never blocks, since an unexpected reply is ignored
+func replyProvide(replyChan chan<- *reply, result *reply) {
+	select {
+	case replyChan <- result:
+	default:
+	}
+}
+
+// request sends the message created after the slot for the reply
+// is acquired and waits for the reply
+func (api *Instance) request(ctx context.Context, replyType uint32, message func() ([]byte, error)) (*reply, error) {
+	err := api.closedCheck()
+	if err != nil {
+		return nil, err
+	}
+	slot := api.replies[replyType]
+	select {
+	case slot.token <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-api.terminated:
+		return nil, api.closedCheck()
+	case <-api.closed:
+		return nil, api.closedCheck()
+	}
+	release := func() {
+		<-slot.token
+	}
+	var data []byte
+	data, err = message()
+	if err == nil {
+		err = api.send(data)
+	}
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return api.replyWait(ctx, slot.reply, release)
+}
+
+func (api *Instance) replyWait(ctx context.Context, replyChan <-chan *reply, release func()) (*reply, error) {
+	select {
+	case result := <-replyChan:
+		release()
+		return result, nil
+	case <-ctx.Done():
+		// the reply will still be sent by the CloudI core
+		go func() {
+			select {
+			case <-replyChan:
+			case <-api.terminated:
+			case <-api.closed:
+			}
+			release()
+		}()
+		return nil, ctx.Err()
+	case <-api.terminated:
+		release()
+		return nil, api.closedCheck()
+	case <-api.closed:
+		release()
+		return nil, api.closedCheck()
+	}
+}
+
+// recvAsyncAcquire allows only a single recv_async request for each trans id
+// (a null trans id receives any response, so it is the only request allowed)
+func (api *Instance) recvAsyncAcquire(ctx context.Context, transId [16]byte) (chan *reply, func(), error) {
+	for true {
+		api.recvAsyncLock.Lock()
+		_, waitingAny := api.recvAsync[[16]byte{}]
+		_, waiting := api.recvAsync[transId]
+		if !waitingAny && !waiting && (transId != [16]byte{} || len(api.recvAsync) == 0) {
+			replyChan := make(chan *reply, 1)
+			api.recvAsync[transId] = replyChan
+			api.recvAsyncLock.Unlock()
+			release := func() {
+				api.recvAsyncLock.Lock()
+				delete(api.recvAsync, transId)
+				close(api.recvAsyncChanged)
+				api.recvAsyncChanged = make(chan struct{})
+				api.recvAsyncLock.Unlock()
+			}
+			return replyChan, release, nil
+		}
+		changed := api.recvAsyncChanged
+		api.recvAsyncLock.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-api.terminated:
+			return nil, nil, api.closedCheck()
+		case <-api.closed:
+			return nil, nil, api.closedCheck()
+		}
+	}
+	return nil, nil, nil
+}
+
+func (api *Instance) recvAsyncReply(result *reply) {
+	var transId [16]byte
+	api.recvAsyncLock.Lock()
+	replyChan, ok := api.recvAsync[transId]
+	if !ok {
+		copy(transId[:], result.transId)
+		replyChan, ok = api.recvAsync[transId]
+	}
+	api.recvAsyncLock.Unlock()
+	if ok {
+		replyProvide(replyChan, result)
+	}
+}
+
+func (api *Instance) requestsPush(request *Request) {
+	api.requestsLock.Lock()
+	_ = api.requests.PushBack(request)
+	api.requestsLock.Unlock()
+	select {
+	case api.requestsReady <- struct{}{}:
+	default:
+	}
+}
+
+func (api *Instance) requestsPop() *Request {
+	api.requestsLock.Lock()
+	defer api.requestsLock.Unlock()
+	element := api.requests.Front()
+	if element == nil {
+		return nil
+	}
+	return api.requests.Remove(element).(*Request)
+}
+
+func (api *Instance) terminateSet() {
+	api.terminateOnce.Do(func() {
+		close(api.terminated)
+	})
+}
+
+// closedCheck returns an error if the Instance can no longer be used
+func (api *Instance) closedCheck() error {
+	select {
+	case <-api.terminated:
+		return terminateErrorNew(api.timeoutTerminate)
+	default:
+	}
+	select {
+	case <-api.closed:
+		return api.errRecv
+	default:
+	}
+	return nil
+}
+
+func (api *Instance) polling() error {
+	api.lock.Lock()
+	defer api.lock.Unlock()
+	if api.initializationComplete {
+		return nil
+	}
+	polling, err := erlang.TermToBinary(erlang.OtpErlangAtom("polling"), -1)
+	if err != nil {
+		return err
+	}
+	err = api.send(polling)
+	if err != nil {
+		return err
+	}
+	api.initializationComplete = true
+	return nil
+}
+
+func timeoutContext(ctx context.Context, timeout uint32) (uint32, error) {
+	err := ctx.Err()
+	if err != nil {
+		return 0, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return timeout, nil
+	}
+	remaining := time.Until(deadline) / time.Millisecond
+	if remaining <= 0 {
+		return 0, context.DeadlineExceeded
+	}
+	if remaining < time.Duration(timeout) {
+		return uint32(remaining), nil
+	}
+	return timeout, nil
+}
+
+// Poll blocks to process incoming CloudI service requests
+// (service requests are only processed by Poll and the CloudI core
+// provides the next service request to a thread only after the response
+// to the previous one, so the count_thread service configuration value
+// determines how many service requests are handled concurrently)
+func (api *Instance) Poll(timeout int32) (bool, error) {
+	err := api.polling()
+	if err != nil {
+		return false, err
+	}
+	pollTimer := time.Now()
+	var pollTimeout <-chan time.Time
+	if timeout >= 0 {
+		pollTimerDuration := time.Duration(timeout) * time.Millisecond
+		if timeout == 0 {
+			pollTimerDuration = time.Duration(500) * time.Microsecond
+		}
+		timer := time.NewTimer(pollTimerDuration)
+		defer timer.Stop()
+		pollTimeout = timer.C
+	}
+	for true {
+		select {
+		case <-api.terminated:
 			return false, nil
-		case messageSubscribeCount:
-			var subscribeCount uint32
-			err = binary.Read(reader, nativeEndian, &subscribeCount)
-			if err != nil {
-				return false, err
-			}
-			if reader.Len() > 0 {
-				_, err = api.handleEvents(external, reader, 0)
-				if err != nil {
-					return false, err
+		default:
+		}
+		request := api.requestsPop()
+		if request == nil {
+			select {
+			case <-api.requestsReady:
+				continue
+			case <-api.terminated:
+				return false, nil
+			case <-api.closed:
+				if errors.Is(api.closedCheck(), ErrTerminate) {
+					return false, nil
 				}
+				return false, api.errRecv
+			case <-pollTimeout:
+				return true, nil
 			}
-			api.subscribeCount = subscribeCount
-			return false, nil
-		case messageTerm:
-			_, err = api.handleEvents(external, reader, command)
-			if err != nil {
-				return false, err
-			}
-			return false, nil
-		case messageReinit:
-			err = binary.Read(reader, nativeEndian, &(api.processCount))
-			if err != nil {
-				return false, err
-			}
-			err = binary.Read(reader, nativeEndian, &(api.timeoutAsync))
-			if err != nil {
-				return false, err
-			}
-			err = binary.Read(reader, nativeEndian, &(api.timeoutSync))
-			if err != nil {
-				return false, err
-			}
-			err = binary.Read(reader, nativeEndian, &(api.priorityDefault))
-			if err != nil {
-				return false, err
-			}
-		case messageKeepalive:
-			var keepalive []byte
-			keepalive, err = erlang.TermToBinary(erlang.OtpErlangAtom("keepalive"), -1)
-			if err != nil {
-				return false, err
-			}
-			err = api.send(keepalive)
-			if err != nil {
-				return false, err
-			}
-		default:
-			return false, messageDecodingErrorNew()
 		}
-
+		err = api.callback(request)
+		if err != nil {
+			return false, err
+		}
 		if timeout == 0 {
 			return true, nil
 		} else if timeout > 0 {
@@ -1216,16 +1818,11 @@ func (api *Instance) pollRequest(timeout int32, external bool) (bool, error) {
 	return false, nil
 }
 
-// Poll blocks to process incoming CloudI service requests
-func (api *Instance) Poll(timeout int32) (bool, error) {
-	return api.pollRequest(timeout, true)
-}
-
 // Shutdown the service successfully
 func (api *Instance) Shutdown(extra ...interface{}) error {
 	extraArity := len(extra)
 	if extraArity > 1 {
-		return invalidInputErrorNew()
+		return invalidInputErrorNew("extra")
 	}
 	reason := ""
 	for _, extraArg := range extra {
@@ -1233,7 +1830,7 @@ func (api *Instance) Shutdown(extra ...interface{}) error {
 		case string:
 			reason = arg
 		default:
-			return invalidInputErrorNew()
+			return invalidInputErrorNew("reason")
 		}
 	}
 	shutdown, err := erlang.TermToBinary([]interface{}{erlang.OtpErlangAtom("shutdown"), reason}, -1)
@@ -1322,6 +1919,8 @@ func (api *Instance) send(data []byte) error {
 		}
 		data = buffer.Bytes()
 	}
+	api.sendLock.Lock()
+	defer api.sendLock.Unlock()
 	_, err = api.socket.Write(data)
 	return err
 }
@@ -1345,7 +1944,7 @@ func (api *Instance) recv() ([]byte, error) {
 		var length uint32
 		err = binary.Read(bytes.NewReader(header), binary.BigEndian, &length)
 		if err != nil {
-			return nil, err
+			return nil, messageDecodingErrorNew(0, "length", 0, err)
 		}
 		total = int(length)
 		api.bufferRecv.Grow(total)
@@ -1411,14 +2010,25 @@ func (api *Instance) recvFragment(size int) (int, error) {
 	return i, nil
 }
 
+// transIdNull checks for the null trans id
+// provided when a service request times out
+func transIdNull(transId []byte) bool {
+	for _, c := range transId {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
 func uintGetenv(key string) (uint32, error) {
 	s := os.Getenv(key)
 	if s == "" {
-		return 0, invalidInputErrorNew()
+		return 0, invalidInputErrorNew(key)
 	}
 	i, err := strconv.Atoi(s)
 	if err != nil || i < 0 || uint64(i) > math.MaxUint32 {
-		return 0, invalidInputErrorNew()
+		return 0, invalidInputErrorNew(key)
 	}
 	return uint32(i), nil
 }
@@ -1454,6 +2064,11 @@ func (e *StackErrorWrap) Error() string {
 func (e *StackErrorWrap) Stack() []byte {
 	return e.stack
 }
+
+// Unwrap provides the panic data as an error
+func (e *StackErrorWrap) Unwrap() error {
+	return e.Value
+}
 func errorFormat(output *bytes.Buffer, err error) {
 	_, _ = output.WriteString(reflect.TypeOf(err).String())
 	_, _ = output.WriteString(": ")
@@ -1465,16 +2080,44 @@ func stackErrorFormat(output *bytes.Buffer, stack []byte) {
 	_, _ = output.Write(bytes.TrimSuffix(bytes.Join(bytes.Split(stack, []byte{'\n'}), []byte{'\n', '\t'}), []byte{'\t'}))
 }
 
+var (
+	// ErrInvalidInput matches an InvalidInputError with errors.Is
+	ErrInvalidInput = errors.New("Invalid Input")
+	// ErrReturnSync matches a ReturnSyncError with errors.Is
+	ErrReturnSync = errors.New("Synchronous Call Return Invalid")
+	// ErrReturnAsync matches a ReturnAsyncError with errors.Is
+	ErrReturnAsync = errors.New("Asynchronous Call Return Invalid")
+	// ErrForwardSync matches a ForwardSyncError with errors.Is
+	ErrForwardSync = errors.New("Synchronous Call Forward Invalid")
+	// ErrForwardAsync matches a ForwardAsyncError with errors.Is
+	ErrForwardAsync = errors.New("Asynchronous Call Forward Invalid")
+	// ErrMessageDecoding matches a MessageDecodingError with errors.Is
+	ErrMessageDecoding = errors.New("Message Decoding Error")
+	// ErrTerminate matches a TerminateError with errors.Is
+	ErrTerminate = errors.New("Terminate")
+	// ErrTimeout matches a TimeoutError with errors.Is
+	ErrTimeout = errors.New("Timeout")
+	// ErrNoDestination matches a NoDestinationError with errors.Is
+	ErrNoDestination = errors.New("No Destination")
+)
+
 // InvalidInputError indicates that invalid input was provided
 type InvalidInputError struct {
-	stack []byte
+	// Argument is the name of the invalid argument
+	Argument string
+	stack    []byte
 }
 
-func invalidInputErrorNew() error {
-	return &InvalidInputError{stack: debug.Stack()}
+func invalidInputErrorNew(argument string) error {
+	return &InvalidInputError{Argument: argument, stack: debug.Stack()}
 }
 func (e *InvalidInputError) Error() string {
-	return "Invalid Input"
+	return "Invalid Input: " + e.Argument
+}
+
+// Is provides errors.Is support for ErrInvalidInput
+func (e *InvalidInputError) Is(target error) bool {
+	return target == ErrInvalidInput
 }
 
 // Stack return the stack stored when the error was created
@@ -1484,58 +2127,112 @@ func (e *InvalidInputError) Stack() []byte {
 
 // ReturnSyncError indicates a request was handled with a sync return
 type ReturnSyncError struct {
+	// Name is the service name of the service request
+	Name string
+	// Pattern is the service name pattern of the service request
+	Pattern string
 }
 
-func returnSyncErrorNew() error {
-	return &ReturnSyncError{}
+func returnSyncErrorNew(name, pattern string) error {
+	return &ReturnSyncError{Name: name, Pattern: pattern}
 }
 func (e *ReturnSyncError) Error() string {
-	return "Synchronous Call Return Invalid"
+	return fmt.Sprintf("Synchronous Call Return Invalid (\"%s\")", e.Name)
+}
+
+// Is provides errors.Is support for ErrReturnSync
+func (e *ReturnSyncError) Is(target error) bool {
+	return target == ErrReturnSync
 }
 
 // ReturnAsyncError indicates a request was handled with an async return
 type ReturnAsyncError struct {
+	// Name is the service name of the service request
+	Name string
+	// Pattern is the service name pattern of the service request
+	Pattern string
 }
 
-func returnAsyncErrorNew() error {
-	return &ReturnAsyncError{}
+func returnAsyncErrorNew(name, pattern string) error {
+	return &ReturnAsyncError{Name: name, Pattern: pattern}
 }
 func (e *ReturnAsyncError) Error() string {
-	return "Asynchronous Call Return Invalid"
+	return fmt.Sprintf("Asynchronous Call Return Invalid (\"%s\")", e.Name)
+}
+
+// Is provides errors.Is support for ErrReturnAsync
+func (e *ReturnAsyncError) Is(target error) bool {
+	return target == ErrReturnAsync
 }
 
 // ForwardSyncError indicates a request was handled with a sync forward
 type ForwardSyncError struct {
+	// Name is the service name the service request was forwarded to
+	Name string
 }
 
-func forwardSyncErrorNew() error {
-	return &ForwardSyncError{}
+func forwardSyncErrorNew(name string) error {
+	return &ForwardSyncError{Name: name}
 }
 func (e *ForwardSyncError) Error() string {
-	return "Synchronous Call Forward Invalid"
+	return fmt.Sprintf("Synchronous Call Forward Invalid (\"%s\")", e.Name)
+}
+
+// Is provides errors.Is support for ErrForwardSync
+func (e *ForwardSyncError) Is(target error) bool {
+	return target == ErrForwardSync
 }
 
 // ForwardAsyncError indicates a request was handled with an async forward
 type ForwardAsyncError struct {
+	// Name is the service name the service request was forwarded to
+	Name string
 }
 
-func forwardAsyncErrorNew() error {
-	return &ForwardAsyncError{}
+func forwardAsyncErrorNew(name string) error {
+	return &ForwardAsyncError{Name: name}
 }
 func (e *ForwardAsyncError) Error() string {
-	return "Asynchronous Call Forward Invalid"
+	return fmt.Sprintf("Asynchronous Call Forward Invalid (\"%s\")", e.Name)
+}
+
+// Is provides errors.Is support for ErrForwardAsync
+func (e *ForwardAsyncError) Is(target error) bool {
+	return target == ErrForwardAsync
 }
 
 // MessageDecodingError indicates an error decoding CloudI messages
 type MessageDecodingError struct {
+	// Command is the CloudI message command (0 if not yet decoded)
+	Command uint32
+	// Field is the name of the message field
+	Field string
+	// Offset is the byte offset of the field within the message
+	Offset int64
+	// Err is the underlying error, if any (e.g., io.ErrUnexpectedEOF)
+	Err   error
 	stack []byte
 }
 
-func messageDecodingErrorNew() error {
-	return &MessageDecodingError{stack: debug.Stack()}
+func messageDecodingErrorNew(command uint32, field string, offset int64, err error) error {
+	return &MessageDecodingError{Command: command, Field: field, Offset: offset, Err: err, stack: debug.Stack()}
 }
 func (e *MessageDecodingError) Error() string {
-	return "Message Decoding Error"
+	message := fmt.Sprintf("Message Decoding Error: command %d field %s offset %d", e.Command, e.Field, e.Offset)
+	if e.Err != nil {
+		message += ": " + e.Err.Error()
+	}
+	return message
+}
+
+// Is provides errors.Is support for ErrMessageDecoding
+func (e *MessageDecodingError) Is(target error) bool {
+	return target == ErrMessageDecoding
+}
+
+// Unwrap provides the underlying error
+func (e *MessageDecodingError) Unwrap() error {
+	return e.Err
 }
 
 // Stack return the stack stored when the error was created
@@ -1555,11 +2252,59 @@ func (e *TerminateError) Error() string {
 	return "Terminate"
 }
 
+// Is provides errors.Is support for ErrTerminate
+func (e *TerminateError) Is(target error) bool {
+	return target == ErrTerminate
+}
+
 // Timeout provides the termination timeout configured for the service
 func (e *TerminateError) Timeout() uint32 {
 	return e.timeout
 }
 
+// TimeoutError indicates that a service request timed out
+// (only provided when using WithTimeoutError)
+type TimeoutError struct {
+	// Name is the service name (empty for RecvAsync)
+	Name string
+	// Timeout is the timeout in milliseconds
+	Timeout uint32
+}
+
+func timeoutErrorNew(name string, timeout uint32) error {
+	return &TimeoutError{Name: name, Timeout: timeout}
+}
+func (e *TimeoutError) Error() string {
+	if e.Name == "" {
+		return fmt.Sprintf("Timeout after %d ms", e.Timeout)
+	}
+	return fmt.Sprintf("Timeout after %d ms sending to \"%s\"", e.Timeout, e.Name)
+}
+
+// Is provides errors.Is support for ErrTimeout
+func (e *TimeoutError) Is(target error) bool {
+	return target == ErrTimeout
+}
+
+// NoDestinationError indicates that McastAsync found no destinations
+// (only provided when using WithTimeoutError)
+type NoDestinationError struct {
+	// Name is the service name
+	Name string
+}
+
+func noDestinationErrorNew(name string) error {
+	return &NoDestinationError{Name: name}
+}
+func (e *NoDestinationError) Error() string {
+	return fmt.Sprintf("No Destination for \"%s\"", e.Name)
+}
+
+// Is provides errors.Is support for ErrNoDestination
+func (e *NoDestinationError) Is(target error) bool {
+	return target == ErrNoDestination
+}
+
 // ErrorWrite outputs error information to the cloudi.log file through stderr
 func ErrorWrite(stream *os.File, err error) {
 	output := new(bytes.Buffer)
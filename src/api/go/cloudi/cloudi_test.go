@@ -0,0 +1,1695 @@
+package cloudi_test
+
+//-*-Mode:Go;coding:utf-8;tab-width:4;c-basic-offset:4-*-
+// ex: set ft=go fenc=utf-8 sts=4 ts=4 sw=4 noet nomod:
+//
+// MIT License
+//
+// Copyright (c) 2017-2020 Michael Truog <mjtruog at protonmail dot com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+// DEALINGS IN THE SOFTWARE.
+//
+
+import (
+	"bytes"
+	"cloudi"
+	"clouditest"
+	"context"
+	"encoding/json"
+	"erlang"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func assertEqual(t *testing.T, expect interface{}, result interface{}, message string) {
+	if reflect.DeepEqual(expect, result) {
+		return
+	}
+	if len(message) == 0 {
+		message = fmt.Sprintf("%#v != %#v", expect, result)
+	}
+	t.Fail()
+	log.SetPrefix("\t")
+	log.SetFlags(log.Lshortfile)
+	log.Output(2, message)
+}
+
+func assertNoError(t *testing.T, err error) {
+	if err == nil {
+		return
+	}
+	log.SetPrefix("\t")
+	log.SetFlags(log.Lshortfile)
+	log.Output(2, err.Error())
+	t.FailNow()
+}
+
+type service struct {
+	core *clouditest.Core
+	api  *cloudi.Instance
+	poll chan error
+}
+
+func serviceNew(t *testing.T, config clouditest.Config, state interface{}) *service {
+	core, err := clouditest.New(config)
+	assertNoError(t, err)
+	var api *cloudi.Instance
+	api, err = core.API(state)
+	assertNoError(t, err)
+	return &service{core: core, api: api, poll: make(chan error, 1)}
+}
+
+func (s *service) start(t *testing.T) {
+	go func() {
+		_, err := s.api.Poll(-1)
+		s.poll <- err
+	}()
+	assertNoError(t, s.core.WaitPolling(time.Second))
+}
+
+func (s *service) stop(t *testing.T) {
+	assertNoError(t, s.core.Terminate())
+	select {
+	case err := <-s.poll:
+		assertNoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Poll did not return after termination")
+	}
+	assertNoError(t, s.core.Close())
+}
+
+func TestInitialization(t *testing.T) {
+	config := clouditest.ConfigDefault()
+	config.ProcessIndex = 2
+	config.ProcessCount = 4
+	config.ProcessCountMax = 8
+	config.ProcessCountMin = 3
+	config.Prefix = "/tests/go/"
+	config.TimeoutSync = 1234
+	s := serviceNew(t, config, nil)
+	assertEqual(t, uint32(2), s.api.ProcessIndex(), "")
+	assertEqual(t, uint32(4), s.api.ProcessCount(), "")
+	assertEqual(t, uint32(8), s.api.ProcessCountMax(), "")
+	assertEqual(t, uint32(3), s.api.ProcessCountMin(), "")
+	assertEqual(t, "/tests/go/", s.api.Prefix(), "")
+	assertEqual(t, uint32(1234), s.api.TimeoutSync(), "")
+	count, err := s.api.SubscribeCount("echo")
+	assertNoError(t, err)
+	assertEqual(t, uint32(0), count, "")
+	s.start(t)
+	assertNoError(t, s.core.Reinit(5, 100, 200, -2))
+	assertNoError(t, s.core.Keepalive(time.Second))
+	s.stop(t)
+	assertEqual(t, uint32(5), s.api.ProcessCount(), "")
+	assertEqual(t, uint32(100), s.api.TimeoutAsync(), "")
+	assertEqual(t, uint32(200), s.api.TimeoutSync(), "")
+}
+
+func TestReturn(t *testing.T) {
+	s := serviceNew(t, clouditest.ConfigDefault(), nil)
+	echo := func(requestType int, name, pattern string, requestInfo, request []byte, timeout uint32, priority int8, transId [16]byte, pid cloudi.Source, state interface{}, api *cloudi.Instance) ([]byte, []byte, error) {
+		api.Return(requestType, name, pattern, requestInfo, request, timeout, transId, pid)
+		return nil, nil, nil
+	}
+	assertNoError(t, s.api.Subscribe("echo", echo))
+	s.start(t)
+	assertEqual(t, map[string]uint32{"/echo": 1}, s.core.Subscriptions(), "")
+	result, err := s.core.SendSync("/echo", []byte("info"), []byte("hello"))
+	assertNoError(t, err)
+	assertEqual(t, "return_sync", result.Command, "")
+	assertEqual(t, []byte("info"), result.ResponseInfo, "")
+	assertEqual(t, []byte("hello"), result.Response, "")
+	result, err = s.core.SendAsync("/echo", nil, []byte("world"))
+	assertNoError(t, err)
+	assertEqual(t, "return_async", result.Command, "")
+	assertEqual(t, []byte("world"), result.Response, "")
+	s.stop(t)
+}
+
+func TestForward(t *testing.T) {
+	s := serviceNew(t, clouditest.ConfigDefault(), nil)
+	forward := func(requestType int, name, pattern string, requestInfo, request []byte, timeout uint32, priority int8, transId [16]byte, pid cloudi.Source, state interface{}, api *cloudi.Instance) ([]byte, []byte, error) {
+		api.Forward(requestType, "/destination", requestInfo, request, timeout, priority, transId, pid)
+		return nil, nil, nil
+	}
+	assertNoError(t, s.api.Subscribe("forward", forward))
+	s.start(t)
+	result, err := s.core.Send(clouditest.Request{RequestType: cloudi.SYNC, Name: "/forward", Request: []byte("data"), Timeout: 1000, Priority: -1})
+	assertNoError(t, err)
+	assertEqual(t, true, result.Forwarded(), "")
+	assertEqual(t, "/destination", result.Name, "")
+	assertEqual(t, []byte("data"), result.Request, "")
+	// limited by the remaining service request timeout
+	assertEqual(t, true, result.Timeout <= 1000 && result.Timeout > 900, "")
+	assertEqual(t, int8(-1), result.Priority, "")
+	s.stop(t)
+}
+
+func TestHandler(t *testing.T) {
+	s := serviceNew(t, clouditest.ConfigDefault(), "state")
+	// the fake CloudI core does not change the process environment
+	_, found := os.LookupEnv("CLOUDI_API_INIT_PROTOCOL")
+	assertEqual(t, false, found, "")
+	handler := func(request *cloudi.Request) (*cloudi.Response, error) {
+		assertEqual(t, cloudi.SYNC, request.RequestType, "")
+		assertEqual(t, request.Name, request.Pattern, "")
+		assertEqual(t, int8(2), request.Priority, "")
+		assertEqual(t, "state", request.State(), "")
+		assertEqual(t, s.api, request.API(), "")
+		return &cloudi.Response{
+			ResponseInfo: request.RequestInfo,
+			Response:     append([]byte("handled "), request.Request...),
+		}, nil
+	}
+	assertNoError(t, s.api.SubscribeHandler("handler", cloudi.HandlerFunc(handler)))
+	assertNoError(t, s.api.SubscribeHandler("handler_func", cloudi.HandlerFunc(handler)))
+	assertEqual(t, true, errors.Is(s.api.SubscribeHandler("nil", nil), cloudi.ErrInvalidInput), "")
+	assertEqual(t, true, errors.Is(s.api.Subscribe("nil", nil), cloudi.ErrInvalidInput), "")
+	s.start(t)
+	result, err := s.core.Send(clouditest.Request{RequestType: cloudi.SYNC, Name: "/handler", RequestInfo: []byte("info"), Request: []byte("request"), Timeout: 1000, Priority: 2})
+	assertNoError(t, err)
+	assertEqual(t, []byte("info"), result.ResponseInfo, "")
+	assertEqual(t, []byte("handled request"), result.Response, "")
+	result, err = s.core.Send(clouditest.Request{RequestType: cloudi.SYNC, Name: "/handler_func", Request: []byte("function"), Timeout: 1000, Priority: 2})
+	assertNoError(t, err)
+	assertEqual(t, []byte("handled function"), result.Response, "")
+	s.stop(t)
+}
+
+func TestSend(t *testing.T) {
+	s := serviceNew(t, clouditest.ConfigDefault(), nil)
+	s.core.Respond("/upper", func(request *clouditest.Message) ([]byte, []byte) {
+		return nil, append([]byte("upper "), request.Request...)
+	})
+	s.core.Respond("/replica", func(request *clouditest.Message) ([]byte, []byte) {
+		return nil, []byte("1")
+	})
+	s.core.Respond("/replica", func(request *clouditest.Message) ([]byte, []byte) {
+		return nil, []byte("2")
+	})
+	send := func(requestType int, name, pattern string, requestInfo, request []byte, timeout uint32, priority int8, transId [16]byte, pid cloudi.Source, state interface{}, api *cloudi.Instance) ([]byte, []byte, error) {
+		_, response, _, err := api.SendSync("/upper", nil, request)
+		return nil, response, err
+	}
+	assertNoError(t, s.api.Subscribe("send", send))
+	// the instance is used before Poll is called
+	transId, err := s.api.SendAsync("/upper", nil, []byte("async"))
+	assertNoError(t, err)
+	var response, transIdCheck []byte
+	_, response, transIdCheck, err = s.api.RecvAsync(transId)
+	assertNoError(t, err)
+	assertEqual(t, []byte("upper async"), response, "")
+	assertEqual(t, transId, transIdCheck, "")
+	transIds, err := s.api.McastAsync("/replica", nil, nil)
+	assertNoError(t, err)
+	assertEqual(t, 2, len(transIds), "")
+	responses := map[string]bool{}
+	for _, transId := range transIds {
+		_, response, _, err = s.api.RecvAsync(transId)
+		assertNoError(t, err)
+		responses[string(response)] = true
+	}
+	assertEqual(t, map[string]bool{"1": true, "2": true}, responses, "")
+	_, response, transIdCheck, err = s.api.SendSync("/missing", nil, nil)
+	assertNoError(t, err)
+	assertEqual(t, []byte{}, response, "")
+	assertEqual(t, make([]byte, 16), transIdCheck, "")
+	s.start(t)
+	var result *clouditest.Result
+	result, err = s.core.SendSync("/send", nil, []byte("request"))
+	assertNoError(t, err)
+	assertEqual(t, []byte("upper request"), result.Response, "")
+	messages := s.core.Messages("send_sync")
+	assertEqual(t, 2, len(messages), "")
+	assertEqual(t, "/missing", messages[0].Name, "")
+	assertEqual(t, "/upper", messages[1].Name, "")
+	assertEqual(t, []byte("request"), messages[1].Request, "")
+	s.stop(t)
+}
+
+func TestSendConcurrent(t *testing.T) {
+	s := serviceNew(t, clouditest.ConfigDefault(), nil)
+	s.core.Respond("/echo", func(request *clouditest.Message) ([]byte, []byte) {
+		time.Sleep(time.Millisecond)
+		return request.RequestInfo, request.Request
+	})
+	send := func(request *cloudi.Request) (*cloudi.Response, error) {
+		_, response, _, err := request.API().SendSync("/echo", nil, request.Request)
+		return &cloudi.Response{Response: response}, err
+	}
+	assertNoError(t, s.api.SubscribeHandler("send", cloudi.HandlerFunc(send)))
+	s.start(t)
+	const senders = 8
+	var wait sync.WaitGroup
+	wait.Add(senders + 1)
+	go func() {
+		defer wait.Done()
+		for i := 0; i < 10; i++ {
+			request := []byte("callback " + strconv.Itoa(i))
+			result, err := s.core.SendSync("/send", nil, request)
+			assertEqual(t, nil, err, "")
+			assertEqual(t, request, result.Response, "")
+		}
+	}()
+	for sender := 0; sender < senders; sender++ {
+		go func(sender int) {
+			defer wait.Done()
+			for i := 0; i < 10; i++ {
+				request := []byte(strconv.Itoa(sender) + " " + strconv.Itoa(i))
+				var response []byte
+				var err error
+				if sender%2 == 0 {
+					_, response, _, err = s.api.SendSync("/echo", nil, request)
+				} else {
+					var transId []byte
+					transId, err = s.api.SendAsync("/echo", request, request)
+					assertEqual(t, nil, err, "")
+					var responseInfo, transIdCheck []byte
+					responseInfo, response, transIdCheck, err = s.api.RecvAsync(transId)
+					assertEqual(t, request, responseInfo, "")
+					assertEqual(t, transId, transIdCheck, "")
+				}
+				assertEqual(t, nil, err, "")
+				assertEqual(t, request, response, "")
+			}
+		}(sender)
+	}
+	wait.Wait()
+	s.stop(t)
+}
+
+// deadlineContext is done with context.DeadlineExceeded when the
+// parent is cancelled (without limiting the service request timeout)
+type deadlineContext struct {
+	context.Context
+}
+
+func (ctx deadlineContext) Err() error {
+	if ctx.Context.Err() != nil {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
+
+func TestSendSyncContext(t *testing.T) {
+	s := serviceNew(t, clouditest.ConfigDefault(), nil)
+	release := make(chan struct{})
+	expire := make(chan struct{})
+	s.core.Respond("/slow", func(request *clouditest.Message) ([]byte, []byte) {
+		<-release
+		return nil, []byte("slow")
+	})
+	s.core.Respond("/pending", func(request *clouditest.Message) ([]byte, []byte) {
+		close(expire)
+		<-release
+		return nil, []byte("pending")
+	})
+	s.core.Respond("/fast", func(request *clouditest.Message) ([]byte, []byte) {
+		return nil, []byte("fast")
+	})
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Millisecond))
+	_, _, _, err := s.api.SendSyncContext(ctx, "/slow", nil, nil)
+	cancel()
+	assertEqual(t, context.DeadlineExceeded, err, "")
+	assertEqual(t, 0, len(s.core.Messages("send_sync")), "")
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	_, _, _, err = s.api.SendSyncContext(ctx, "/fast", nil, nil)
+	cancel()
+	assertNoError(t, err)
+	messages := s.core.Messages("send_sync")
+	assertEqual(t, 1, len(messages), "")
+	assertEqual(t, true, messages[0].Timeout <= 200, "")
+	// the deadline expires while the service request is pending
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		<-expire
+		cancel()
+	}()
+	_, _, _, err = s.api.SendSyncContext(deadlineContext{ctx}, "/pending", nil, nil)
+	assertEqual(t, context.DeadlineExceeded, err, "")
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err = s.api.SendAsyncContext(ctx, "/slow", nil, nil)
+	assertNoError(t, err)
+	_, _, _, err = s.api.RecvAsyncContext(ctx)
+	assertEqual(t, context.Canceled, err, "")
+	_, _, _, err = s.api.SendSyncContext(ctx, "/fast", nil, nil)
+	assertEqual(t, context.Canceled, err, "")
+	close(release)
+	// the abandoned responses are not provided to later requests
+	var response []byte
+	_, response, _, err = s.api.SendSync("/fast", nil, nil)
+	assertNoError(t, err)
+	assertEqual(t, []byte("fast"), response, "")
+	// the cancelled recv_async consumed the slow response
+	_, response, _, err = s.api.RecvAsync(100)
+	assertNoError(t, err)
+	assertEqual(t, []byte{}, response, "")
+	s.start(t)
+	s.stop(t)
+}
+
+func TestSendOptions(t *testing.T) {
+	s := serviceNew(t, clouditest.ConfigDefault(), nil)
+	s.core.Respond("/echo", func(request *clouditest.Message) ([]byte, []byte) {
+		return nil, request.Request
+	})
+	ctx := context.Background()
+	_, response, _, err := s.api.SendSyncOptions(ctx, "/echo", nil, []byte("options"), cloudi.WithTimeout(1500*time.Millisecond), cloudi.WithPriority(cloudi.PriorityHigh))
+	assertNoError(t, err)
+	assertEqual(t, []byte("options"), response, "")
+	_, response, _, err = s.api.SendSync("/echo", nil, []byte("variadic"), 1000, -5)
+	assertNoError(t, err)
+	assertEqual(t, []byte("variadic"), response, "")
+	_, _, _, err = s.api.SendSync("/echo", nil, nil, 1000, 128)
+	assertEqual(t, true, err != nil, "")
+	_, _, _, err = s.api.SendSync("/echo", nil, nil, 1000, int16(-129))
+	assertEqual(t, true, err != nil, "")
+	_, err = s.api.SendAsyncOptions(ctx, "/echo", nil, nil, cloudi.WithTimeout(-time.Second))
+	assertEqual(t, true, err != nil, "")
+	var priority cloudi.Priority
+	priority, err = cloudi.PriorityNew(-128)
+	assertNoError(t, err)
+	assertEqual(t, cloudi.PriorityHigh, priority, "")
+	_, err = cloudi.PriorityNew(-129)
+	assertEqual(t, true, err != nil, "")
+	messages := s.core.Messages("send_sync")
+	assertEqual(t, 2, len(messages), "")
+	assertEqual(t, uint32(1500), messages[0].Timeout, "")
+	assertEqual(t, int8(-128), messages[0].Priority, "")
+	assertEqual(t, uint32(1000), messages[1].Timeout, "")
+	assertEqual(t, int8(-5), messages[1].Priority, "")
+	s.start(t)
+	s.stop(t)
+}
+
+func TestServe(t *testing.T) {
+	var cores []*clouditest.Core
+	var instances []*cloudi.Instance
+	for i := 0; i < 2; i++ {
+		s := serviceNew(t, clouditest.ConfigDefault(), nil)
+		cores = append(cores, s.core)
+		instances = append(instances, s.api)
+	}
+	setup := func(api *cloudi.Instance) error {
+		return api.SubscribeHandler("echo", cloudi.HandlerFunc(func(request *cloudi.Request) (*cloudi.Response, error) {
+			return &cloudi.Response{Response: request.Request}, nil
+		}))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- cloudi.Serve(ctx, instances, setup)
+	}()
+	for _, core := range cores {
+		assertNoError(t, core.WaitPolling(time.Second))
+		result, err := core.SendSync("/echo", nil, []byte("serve"))
+		assertNoError(t, err)
+		assertEqual(t, []byte("serve"), result.Response, "")
+	}
+	cancel()
+	for _, core := range cores {
+		for i := 0; len(core.Messages("shutdown")) == 0; i++ {
+			if i == 100 {
+				t.Fatal("Shutdown was not called")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		assertNoError(t, core.Terminate())
+	}
+	select {
+	case err := <-served:
+		assertNoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Serve did not return after termination")
+	}
+	for _, core := range cores {
+		assertNoError(t, core.Close())
+	}
+
+	s := serviceNew(t, clouditest.ConfigDefault(), nil)
+	err := cloudi.Serve(context.Background(), []*cloudi.Instance{s.api}, func(api *cloudi.Instance) error {
+		return fmt.Errorf("setup failed")
+	})
+	errRun, ok := err.(*cloudi.RunError)
+	assertEqual(t, true, ok, "")
+	assertEqual(t, 1, len(errRun.Errors), "")
+	assertEqual(t, "setup failed", err.Error(), "")
+	assertNoError(t, s.core.Close())
+}
+
+func TestDeferred(t *testing.T) {
+	s := serviceNew(t, clouditest.ConfigDefault(), nil)
+	release := make(chan struct{})
+	responders := make(chan *cloudi.Responder, 1)
+	deferred := func(request *cloudi.Request) (*cloudi.Response, error) {
+		responder := request.Defer()
+		switch string(request.Request) {
+		case "expire":
+			responders <- responder
+			// the expiration is based on the remaining timeout
+			time.Sleep(200 * time.Millisecond)
+			return responder.Deferred()
+		case "result":
+			// the Responder is not used
+			responders <- responder
+			return &cloudi.Response{Response: []byte("result")}, nil
+		case "early":
+			assertNoError(t, responder.Return(nil, []byte("early")))
+			return &cloudi.Response{Response: []byte("late")}, nil
+		}
+		go func() {
+			<-release
+			assertEqual(t, nil, responder.Return(nil, append([]byte("deferred "), request.Request...)), "")
+			assertEqual(t, true, responder.Return(nil, nil) != nil, "")
+		}()
+		return responder.Deferred()
+	}
+	assertNoError(t, s.api.SubscribeHandler("deferred", cloudi.HandlerFunc(deferred)))
+	assertNoError(t, s.api.SubscribeHandler("echo", cloudi.HandlerFunc(func(request *cloudi.Request) (*cloudi.Response, error) {
+		return &cloudi.Response{Response: request.Request}, nil
+	})))
+	s.start(t)
+	results := make(chan *clouditest.Result, 1)
+	go func() {
+		result, err := s.core.SendSync("/deferred", nil, []byte("request"))
+		assertEqual(t, nil, err, "")
+		results <- result
+	}()
+	// Poll handles other service requests before the deferred response
+	result, err := s.core.SendSync("/echo", nil, []byte("echo"))
+	assertNoError(t, err)
+	assertEqual(t, []byte("echo"), result.Response, "")
+	close(release)
+	result = <-results
+	assertEqual(t, "return_sync", result.Command, "")
+	assertEqual(t, []byte("deferred request"), result.Response, "")
+	result, err = s.core.SendSync("/deferred", nil, []byte("result"))
+	assertNoError(t, err)
+	assertEqual(t, []byte("result"), result.Response, "")
+	assertEqual(t, true, errors.Is((<-responders).Return(nil, nil), cloudi.ErrInvalidInput), "")
+	result, err = s.core.SendSync("/deferred", nil, []byte("early"))
+	assertNoError(t, err)
+	assertEqual(t, []byte("early"), result.Response, "")
+	assertEqual(t, 4, len(s.core.Messages("return_sync")), "")
+	start := time.Now()
+	go func() {
+		_, _ = s.core.Send(clouditest.Request{RequestType: cloudi.ASYNC, Name: "/deferred", Request: []byte("expire"), Timeout: 300})
+	}()
+	responder := <-responders
+	for i := 0; len(s.core.Messages("return_async")) == 0; i++ {
+		if i == 100 {
+			t.Fatal("the deferred response did not expire")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assertEqual(t, true, time.Since(start) < 450*time.Millisecond, "")
+	assertEqual(t, []byte{}, s.core.Messages("return_async")[0].Response, "")
+	assertEqual(t, true, responder.Return(nil, []byte("late")) != nil, "")
+	s.stop(t)
+}
+
+func TestRespond(t *testing.T) {
+	s := serviceNew(t, clouditest.ConfigDefault(), nil)
+	deferred := make(chan string, 1)
+	respond := func(requestType int, name, pattern string, requestInfo, request []byte, timeout uint32, priority int8, transId [16]byte, pid cloudi.Source, state interface{}, api *cloudi.Instance) ([]byte, []byte, error) {
+		defer func() {
+			deferred <- "respond"
+		}()
+		return api.Respond(requestType, name, pattern, requestInfo, request, timeout, transId, pid)
+	}
+	forward := func(requestType int, name, pattern string, requestInfo, request []byte, timeout uint32, priority int8, transId [16]byte, pid cloudi.Source, state interface{}, api *cloudi.Instance) ([]byte, []byte, error) {
+		return api.ForwardTo(requestType, "/destination", requestInfo, request, timeout, priority, transId, pid)
+	}
+	handler := func(request *cloudi.Request) (*cloudi.Response, error) {
+		return request.Forward("/handler/destination", nil, request.Request, request.Timeout, request.Priority)
+	}
+	assertNoError(t, s.api.Subscribe("respond", respond))
+	assertNoError(t, s.api.Subscribe("forward", forward))
+	assertNoError(t, s.api.SubscribeHandler("handler", cloudi.HandlerFunc(handler)))
+	s.start(t)
+	result, err := s.core.SendSync("/respond", []byte("info"), []byte("respond"))
+	assertNoError(t, err)
+	assertEqual(t, "return_sync", result.Command, "")
+	assertEqual(t, []byte("respond"), result.Response, "")
+	assertEqual(t, "respond", <-deferred, "")
+	result, err = s.core.SendAsync("/forward", nil, []byte("forward"))
+	assertNoError(t, err)
+	assertEqual(t, "forward_async", result.Command, "")
+	assertEqual(t, "/destination", result.Name, "")
+	result, err = s.core.SendSync("/handler", nil, []byte("handler"))
+	assertNoError(t, err)
+	assertEqual(t, "forward_sync", result.Command, "")
+	assertEqual(t, "/handler/destination", result.Name, "")
+	assertEqual(t, []byte("handler"), result.Request, "")
+	// only a single response is sent for each service request
+	assertEqual(t, 1, len(s.core.Messages("return_sync")), "")
+	assertEqual(t, 0, len(s.core.Messages("return_async")), "")
+	s.stop(t)
+}
+
+type sumRequest struct {
+	A int
+	B int
+}
+
+func TestCodec(t *testing.T) {
+	s := serviceNew(t, clouditest.ConfigDefault(), nil)
+	assertNoError(t, cloudi.SubscribeTyped(s.api, "sum", cloudi.CodecJSON, func(request *cloudi.Request, value sumRequest) (int, error) {
+		return value.A + value.B, nil
+	}))
+	assertNoError(t, cloudi.SubscribeTyped(s.api, "upper", cloudi.CodecRaw, func(request *cloudi.Request, value string) (string, error) {
+		return "upper " + value, nil
+	}))
+	s.core.Respond("/double", func(request *clouditest.Message) ([]byte, []byte) {
+		var value int
+		if json.Unmarshal(request.Request, &value) != nil {
+			return nil, []byte("invalid")
+		}
+		return nil, []byte(strconv.Itoa(value * 2))
+	})
+	codecInfo := func(name string) []byte {
+		info, err := cloudi.InfoKeyValueNew(map[string][]string{cloudi.InfoKeyCodec: {name}})
+		assertNoError(t, err)
+		return info
+	}
+	s.start(t)
+	result, err := s.core.SendSync("/sum", nil, []byte(`{"A":1,"B":2}`))
+	assertNoError(t, err)
+	assertEqual(t, []byte("3"), result.Response, "")
+	assertEqual(t, []string{"json"}, cloudi.InfoKeyValueParse(result.ResponseInfo)[cloudi.InfoKeyCodec], "")
+	// the request info selects the codec used by the receiver
+	var request []byte
+	request, err = erlang.TermToBinary(erlang.OtpErlangBinary{Value: []byte("erlang"), Bits: 8}, -1)
+	assertNoError(t, err)
+	result, err = s.core.SendSync("/upper", codecInfo("erlang"), request)
+	assertNoError(t, err)
+	var term interface{}
+	term, err = erlang.BinaryToTerm(result.Response)
+	assertNoError(t, err)
+	assertEqual(t, "upper erlang", term, "")
+	result, err = s.core.SendSync("/upper", codecInfo("missing"), []byte("raw"))
+	assertNoError(t, err)
+	assertEqual(t, []byte{}, result.Response, "")
+	result, err = s.core.SendSync("/sum", nil, []byte("invalid"))
+	assertNoError(t, err)
+	assertEqual(t, []byte{}, result.Response, "")
+	var double int
+	double, _, err = cloudi.SendSyncTyped[int, int](context.Background(), s.api, "/double", cloudi.CodecJSON, 4)
+	assertNoError(t, err)
+	assertEqual(t, 8, double, "")
+	_, _, err = cloudi.SendSyncTyped[string, int](context.Background(), s.api, "/double", cloudi.CodecJSON, "four")
+	var codecError *cloudi.CodecError
+	assertEqual(t, true, errors.As(err, &codecError), "")
+	assertEqual(t, "json", codecError.Codec, "")
+	messages := s.core.Messages("send_sync")
+	assertEqual(t, []string{"json"}, cloudi.InfoKeyValueParse(messages[0].RequestInfo)[cloudi.InfoKeyCodec], "")
+	assertEqual(t, []byte("4"), messages[0].Request, "")
+	s.stop(t)
+}
+
+func TestCodecConvert(t *testing.T) {
+	encode := func(term interface{}) []byte {
+		data, err := cloudi.CodecErlang.Marshal(term)
+		assertNoError(t, err)
+		return data
+	}
+	var codecError *cloudi.CodecError
+	var integer int
+	assertNoError(t, cloudi.CodecErlang.Unmarshal(encode(3.0), &integer))
+	assertEqual(t, 3, integer, "")
+	err := cloudi.CodecErlang.Unmarshal(encode(3.7), &integer)
+	assertEqual(t, true, errors.As(err, &codecError), "")
+	assertEqual(t, "erlang", codecError.Codec, "")
+	var small int8
+	err = cloudi.CodecErlang.Unmarshal(encode(300), &small)
+	assertEqual(t, true, errors.As(err, &codecError), "")
+	var unsigned uint
+	err = cloudi.CodecErlang.Unmarshal(encode(-1), &unsigned)
+	assertEqual(t, true, errors.As(err, &codecError), "")
+	var float float32
+	assertNoError(t, cloudi.CodecErlang.Unmarshal(encode(1.5), &float))
+	assertEqual(t, float32(1.5), float, "")
+	large := new(big.Int).Lsh(big.NewInt(1), 70)
+	var bignum *big.Int
+	assertNoError(t, cloudi.CodecErlang.Unmarshal(encode(large), &bignum))
+	assertEqual(t, 0, large.Cmp(bignum), "")
+	assertNoError(t, cloudi.CodecErlang.Unmarshal(encode(5), &bignum))
+	assertEqual(t, int64(5), bignum.Int64(), "")
+	var integer64 int64
+	err = cloudi.CodecErlang.Unmarshal(encode(large), &integer64)
+	assertEqual(t, true, errors.As(err, &codecError), "")
+	var structure sumRequest
+	err = cloudi.CodecErlang.Unmarshal(encode(5), &structure)
+	assertEqual(t, true, errors.As(err, &codecError), "")
+}
+
+func TestPattern(t *testing.T) {
+	parseValid := []struct {
+		pattern    string
+		name       string
+		parameters []string
+	}{
+		{"aa*", "aaaa", []string{"aa"}},
+		{"aa*", "aab", []string{"b"}},
+		{"aa*b", "aabb", []string{"b"}},
+		{"aa*a*", "aabab", []string{"b", "b"}},
+		{"aa*a*", "aababb", []string{"b", "bb"}},
+		{"aa?a*", "aababb", []string{"b", "bb"}},
+		{"aa*a*", "aabbab", []string{"bb", "b"}},
+		{"aa?a*", "aabbab", []string{"bb", "b"}},
+		{"aa*a*", "aabbabb", []string{"bb", "bb"}},
+		{"aa?a*", "aabbabb", []string{"bb", "bb"}},
+		{"*.txt", "file.name.txt", []string{"file.name"}},
+		{"*/", "///", []string{"//"}},
+		{"aaabb", "aaabb", []string{}},
+		{"/a/b/*/d", "/a/b/c/d", []string{"c"}},
+		{"/*/c/d", "/a/b/c/d", []string{"a/b"}},
+		{"/?/c/d", "/a/c/d", []string{"a"}},
+	}
+	for _, test := range parseValid {
+		parameters, err := cloudi.PatternParse(test.pattern, test.name)
+		assertNoError(t, err)
+		assertEqual(t, test.parameters, parameters, "")
+		var name string
+		name, err = cloudi.PatternFill(test.pattern, parameters)
+		assertNoError(t, err)
+		assertEqual(t, test.name, name, "")
+	}
+	parseMismatch := []struct {
+		pattern string
+		name    string
+	}{
+		{"aa*a*", "aaabb"},
+		{"?atch", "aatch"},
+		{"/?/c/d", "/a/b/c/d"},
+		{"/a/*", "/a/"},
+	}
+	for _, test := range parseMismatch {
+		_, err := cloudi.PatternParse(test.pattern, test.name)
+		_, mismatch := err.(*cloudi.PatternMismatchError)
+		assertEqual(t, true, mismatch, "")
+		var match bool
+		match, err = cloudi.PatternMatch(test.pattern, test.name)
+		assertNoError(t, err)
+		assertEqual(t, false, match, "")
+	}
+	for pattern, expect := range map[string]bool{"abcdef": false, "abc?def": true, "abc?d*ef": true, "abcd*ef": true} {
+		result, err := cloudi.PatternCheck(pattern)
+		assertNoError(t, err)
+		assertEqual(t, expect, result, "")
+	}
+	for _, pattern := range []string{"abc**ef", "abc??ef", "abc?*ef", "abc*?ef", "abcef?"} {
+		_, err := cloudi.PatternCheck(pattern)
+		_, invalid := err.(*cloudi.InvalidInputError)
+		assertEqual(t, true, invalid, "")
+	}
+	_, err := cloudi.PatternParse("/a/*", "/a/*")
+	_, invalid := err.(*cloudi.InvalidInputError)
+	assertEqual(t, true, invalid, "")
+	var name string
+	name, err = cloudi.PatternFill("/a/**", []string{"b", "c"})
+	assertNoError(t, err)
+	assertEqual(t, "/a/bc", name, "")
+	_, err = cloudi.PatternFill("/a/*/*", []string{"b"})
+	_, invalid = err.(*cloudi.InvalidInputError)
+	assertEqual(t, true, invalid, "")
+	_, err = cloudi.PatternFill("/a/*", []string{"b", "c"})
+	_, invalid = err.(*cloudi.InvalidInputError)
+	assertEqual(t, true, invalid, "")
+	s := serviceNew(t, clouditest.ConfigDefault(), nil)
+	assertNoError(t, s.api.SubscribeHandler("a/?/c/*", cloudi.HandlerFunc(func(request *cloudi.Request) (*cloudi.Response, error) {
+		parameters, err := request.API().Parameters(request.Pattern, request.Name)
+		if err != nil {
+			return nil, err
+		}
+		return &cloudi.Response{Response: []byte(strings.Join(parameters, ","))}, nil
+	})))
+	s.start(t)
+	var result *clouditest.Result
+	result, err = s.core.Send(clouditest.Request{RequestType: cloudi.SYNC, Name: "/a/b/c/d", Pattern: "/a/?/c/*", Timeout: 1000})
+	assertNoError(t, err)
+	assertEqual(t, []byte("b,d"), result.Response, "")
+	s.stop(t)
+}
+
+func TestHTTPHandler(t *testing.T) {
+	s := serviceNew(t, clouditest.ConfigDefault(), nil)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/http/value", func(w http.ResponseWriter, r *http.Request) {
+		assertEqual(t, "/http/value/get", cloudi.HTTPRequest(r).Name, "")
+		assertEqual(t, "text/plain", r.Header.Get("Accept"), "")
+		assertEqual(t, "example.com", r.Host, "")
+		assertEqual(t, "127.0.0.1:8080", r.RemoteAddr, "")
+		w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+		fmt.Fprintf(w, "<value>%s</value>", r.URL.Query().Get("value"))
+	})
+	mux.HandleFunc("/http/echo", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assertEqual(t, nil, err, "")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(r.Method + " " + string(body)))
+	})
+	handler := cloudi.HTTPHandler(mux)
+	assertNoError(t, s.api.SubscribeHandler("http/value/get", handler))
+	assertNoError(t, s.api.SubscribeHandler("http/echo/post", handler))
+	assertNoError(t, s.api.SubscribeHandler("http/missing/get", handler))
+	s.start(t)
+	requestInfo, err := cloudi.InfoKeyValueNew(map[string][]string{
+		"accept":         {"text/plain"},
+		"host":           {"example.com"},
+		"source-address": {"127.0.0.1"},
+		"source-port":    {"8080"},
+		"url-path":       {"/http/value"},
+	})
+	assertNoError(t, err)
+	var query []byte
+	query, err = cloudi.InfoKeyValueNew(map[string][]string{"value": {"42"}})
+	assertNoError(t, err)
+	var result *clouditest.Result
+	result, err = s.core.SendSync("/http/value/get", requestInfo, query)
+	assertNoError(t, err)
+	assertEqual(t, []byte("<value>42</value>"), result.Response, "")
+	responseInfo := cloudi.InfoKeyValueParse(result.ResponseInfo)
+	assertEqual(t, []string{"200"}, responseInfo["status"], "")
+	assertEqual(t, []string{"text/xml; charset=utf-8"}, responseInfo["content-type"], "")
+	result, err = s.core.SendSync("/http/echo/post", nil, []byte("body"))
+	assertNoError(t, err)
+	assertEqual(t, []byte("POST body"), result.Response, "")
+	responseInfo = cloudi.InfoKeyValueParse(result.ResponseInfo)
+	assertEqual(t, []string{"201"}, responseInfo["status"], "")
+	assertEqual(t, []string{"text/plain; charset=utf-8"}, responseInfo["content-type"], "")
+	result, err = s.core.SendSync("/http/missing/get", nil, nil)
+	assertNoError(t, err)
+	assertEqual(t, []string{"404"}, cloudi.InfoKeyValueParse(result.ResponseInfo)["status"], "")
+	s.stop(t)
+}
+
+func TestGateway(t *testing.T) {
+	s := serviceNew(t, clouditest.ConfigDefault(), nil)
+	s.core.Respond("/upper", func(request *clouditest.Message) ([]byte, []byte) {
+		responseInfo, _ := cloudi.InfoKeyValueNew(map[string][]string{"type": {"upper"}})
+		return responseInfo, append(request.RequestInfo, request.Request...)
+	})
+	server := httptest.NewServer(s.api.GatewayHandler())
+	defer server.Close()
+	post := func(name string, header map[string]string, body string) *http.Response {
+		r, err := http.NewRequest(http.MethodPost, server.URL+name, strings.NewReader(body))
+		assertNoError(t, err)
+		for key, value := range header {
+			r.Header.Set(key, value)
+		}
+		var response *http.Response
+		response, err = server.Client().Do(r)
+		assertNoError(t, err)
+		return response
+	}
+	response := post("/upper", map[string]string{
+		"X-Cloudi-Info-Key": "value",
+		"X-Cloudi-Timeout":  "2000",
+		"X-Cloudi-Priority": "-1",
+	}, "body")
+	body, err := io.ReadAll(response.Body)
+	assertNoError(t, err)
+	response.Body.Close()
+	assertEqual(t, http.StatusOK, response.StatusCode, "")
+	assertEqual(t, []byte("key\x00value\x00body"), body, "")
+	assertEqual(t, "upper", response.Header.Get("X-Cloudi-Info-Type"), "")
+	assertEqual(t, 36, len(response.Header.Get(cloudi.GatewayHeaderTransId)), "")
+	messages := s.core.Messages("send_sync")
+	assertEqual(t, 1, len(messages), "")
+	assertEqual(t, uint32(2000), messages[0].Timeout, "")
+	assertEqual(t, int8(-1), messages[0].Priority, "")
+	response = post("/upper", map[string]string{cloudi.GatewayHeaderRequestType: "async"}, "async")
+	response.Body.Close()
+	assertEqual(t, http.StatusAccepted, response.StatusCode, "")
+	assertEqual(t, 1, len(s.core.Messages("send_async")), "")
+	response = post("/missing", nil, "")
+	response.Body.Close()
+	assertEqual(t, http.StatusGatewayTimeout, response.StatusCode, "")
+	response = post("/upper", nil, strings.Repeat("x", cloudi.GatewayRequestSizeMax))
+	response.Body.Close()
+	assertEqual(t, http.StatusOK, response.StatusCode, "")
+	response = post("/upper", nil, strings.Repeat("x", cloudi.GatewayRequestSizeMax+1))
+	response.Body.Close()
+	assertEqual(t, http.StatusRequestEntityTooLarge, response.StatusCode, "")
+	recorder := httptest.NewRecorder()
+	s.api.GatewayHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/upper", iotest.ErrReader(errors.New("read"))))
+	assertEqual(t, http.StatusBadRequest, recorder.Code, "")
+	response = post("/upper", map[string]string{"X-Cloudi-Priority": "128"}, "")
+	response.Body.Close()
+	assertEqual(t, http.StatusBadRequest, response.StatusCode, "")
+	response, err = server.Client().Get(server.URL + "/upper")
+	assertNoError(t, err)
+	response.Body.Close()
+	assertEqual(t, http.StatusMethodNotAllowed, response.StatusCode, "")
+	for _, address := range []string{":0", "0.0.0.0:0", "[::]:0", "localhost"} {
+		err = s.api.GatewayListen(context.Background(), address)
+		assertEqual(t, true, errors.Is(err, cloudi.ErrInvalidInput), address)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = s.api.GatewayListen(ctx, "127.0.0.1:0")
+	assertEqual(t, context.Canceled, err, "")
+	assertNoError(t, s.core.Close())
+}
+
+func TestRecvAsyncs(t *testing.T) {
+	s := serviceNew(t, clouditest.ConfigDefault(), nil)
+	release := make(chan struct{})
+	s.core.Respond("/replica", func(request *clouditest.Message) ([]byte, []byte) {
+		return nil, []byte("fast")
+	})
+	s.core.Respond("/replica", func(request *clouditest.Message) ([]byte, []byte) {
+		<-release
+		return nil, []byte("slow")
+	})
+	s.core.Respond("/replica", func(request *clouditest.Message) ([]byte, []byte) {
+		// no response
+		return nil, nil
+	})
+	transIds, err := s.api.McastAsync("/replica", nil, nil)
+	assertNoError(t, err)
+	assertEqual(t, 3, len(transIds), "")
+	var result *cloudi.RecvAsyncsResult
+	result, err = s.api.RecvAsyncsContext(context.Background(), transIds, 1000, 1)
+	assertNoError(t, err)
+	assertEqual(t, 1, len(result.Responses), "")
+	assertEqual(t, 0, len(result.Timeouts), "")
+	assertEqual(t, 2, len(result.Uncollected), "")
+	for _, response := range result.Responses {
+		assertEqual(t, []byte("fast"), response.Response, "")
+	}
+	close(release)
+	transIds, err = s.api.McastAsync("/replica", nil, nil)
+	assertNoError(t, err)
+	start := time.Now()
+	result, err = s.api.RecvAsyncs(transIds, 200)
+	assertNoError(t, err)
+	assertEqual(t, true, time.Since(start) < time.Second, "")
+	assertEqual(t, 2, len(result.Responses), "")
+	assertEqual(t, 1, len(result.Timeouts), "")
+	assertEqual(t, 0, len(result.Uncollected), "")
+	responses := map[string]bool{}
+	for _, response := range result.Responses {
+		responses[string(response.Response)] = true
+	}
+	assertEqual(t, map[string]bool{"fast": true, "slow": true}, responses, "")
+	timeout, err := cloudi.TransIdNew(transIds[2])
+	assertNoError(t, err)
+	assertEqual(t, timeout, result.Timeouts[0], "")
+	_, err = s.api.RecvAsyncs([][]byte{make([]byte, 16)}, 200)
+	_, invalid := err.(*cloudi.InvalidInputError)
+	assertEqual(t, true, invalid, "")
+	assertNoError(t, s.core.Close())
+}
+
+func TestErrors(t *testing.T) {
+	s := serviceNew(t, clouditest.ConfigDefault(), nil)
+	_, _, _, err := s.api.SendSync("", nil, nil)
+	assertEqual(t, true, errors.Is(err, cloudi.ErrInvalidInput), "")
+	var invalidInput *cloudi.InvalidInputError
+	assertEqual(t, true, errors.As(err, &invalidInput), "")
+	assertEqual(t, "name", invalidInput.Argument, "")
+	assertEqual(t, "Invalid Input: name", err.Error(), "")
+	_, err = cloudi.PriorityNew(1000)
+	assertEqual(t, true, errors.As(fmt.Errorf("wrapped: %w", err), &invalidInput), "")
+	assertEqual(t, "value", invalidInput.Argument, "")
+	err = cloudi.StackErrorWrapNew(fmt.Errorf("wrapped: %w", io.ErrUnexpectedEOF))
+	assertEqual(t, true, errors.Is(err, io.ErrUnexpectedEOF), "")
+
+	// a recovered Handler panic is unwrapped
+	exporter := &cloudi.TraceMemoryExporter{}
+	s.api.TraceExporterSet(exporter)
+	panics := func(request *cloudi.Request) (*cloudi.Response, error) {
+		panic(io.ErrUnexpectedEOF)
+	}
+	assertNoError(t, s.api.SubscribeHandler("panic", cloudi.HandlerFunc(panics)))
+
+	// a wrapped return error is still handled as a return
+	responded := make(chan error, 1)
+	respond := func(request *cloudi.Request) (*cloudi.Response, error) {
+		_, _, err := request.API().Respond(request.RequestType, request.Name, request.Pattern, nil, []byte("response"), request.Timeout, request.TransId, request.Source)
+		responded <- err
+		return nil, fmt.Errorf("responded: %w", err)
+	}
+	assertNoError(t, s.api.SubscribeHandler("respond", cloudi.HandlerFunc(respond)))
+	s.start(t)
+	result, err := s.core.SendSync(s.api.Prefix()+"respond", nil, nil)
+	assertNoError(t, err)
+	assertEqual(t, "response", string(result.Message.Response), "")
+	err = <-responded
+	assertEqual(t, true, errors.Is(err, cloudi.ErrReturnSync), "")
+	assertEqual(t, false, errors.Is(err, cloudi.ErrReturnAsync), "")
+	var returnSync *cloudi.ReturnSyncError
+	assertEqual(t, true, errors.As(err, &returnSync), "")
+	assertEqual(t, s.api.Prefix()+"respond", returnSync.Name, "")
+	assertEqual(t, 1, len(s.core.Messages("return_sync")), "")
+	_, err = s.core.SendSync(s.api.Prefix()+"panic", nil, nil)
+	assertNoError(t, err)
+	var spans []*cloudi.Span
+	for _, span := range exporter.Spans() {
+		if span.Pattern == s.api.Prefix()+"panic" {
+			spans = append(spans, span)
+		}
+	}
+	assertEqual(t, 1, len(spans), "")
+	assertEqual(t, true, errors.Is(spans[0].Err, io.ErrUnexpectedEOF), "")
+	var stackError *cloudi.StackErrorWrap
+	assertEqual(t, true, errors.As(spans[0].Err, &stackError), "")
+
+	// a truncated reinit message
+	assertNoError(t, s.core.SendRaw(9, []byte{0, 0}))
+	select {
+	case err = <-s.poll:
+	case <-time.After(time.Second):
+		t.Fatal("Poll did not return after the decoding error")
+	}
+	assertEqual(t, true, errors.Is(err, cloudi.ErrMessageDecoding), "")
+	assertEqual(t, true, errors.Is(err, io.ErrUnexpectedEOF), "")
+	var decoding *cloudi.MessageDecodingError
+	assertEqual(t, true, errors.As(err, &decoding), "")
+	assertEqual(t, uint32(9), decoding.Command, "")
+	assertEqual(t, "processCount", decoding.Field, "")
+	assertEqual(t, int64(4), decoding.Offset, "")
+	assertNoError(t, s.core.Close())
+}
+
+func TestMetrics(t *testing.T) {
+	_, err := cloudi.MetricsNew(2*time.Second, time.Second)
+	_, invalid := err.(*cloudi.InvalidInputError)
+	assertEqual(t, true, invalid, "")
+	metrics, err := cloudi.MetricsNew(time.Millisecond, time.Hour)
+	assertNoError(t, err)
+	s := serviceNew(t, clouditest.ConfigDefault(), nil)
+	assertEqual(t, true, s.api.Stats() == nil, "")
+	s.api.MetricsSet(metrics)
+	ok := func(request *cloudi.Request) (*cloudi.Response, error) {
+		return &cloudi.Response{Response: []byte("ok")}, nil
+	}
+	fail := func(request *cloudi.Request) (*cloudi.Response, error) {
+		return nil, errors.New("failed")
+	}
+	panics := func(request *cloudi.Request) (*cloudi.Response, error) {
+		panic("handler panic")
+	}
+	assertNoError(t, s.api.SubscribeHandler("ok", cloudi.HandlerFunc(ok)))
+	assertNoError(t, s.api.SubscribeHandler("fail", cloudi.HandlerFunc(fail)))
+	assertNoError(t, s.api.SubscribeHandler("panic", cloudi.HandlerFunc(panics)))
+	s.core.Respond("/destination", func(request *clouditest.Message) ([]byte, []byte) {
+		return nil, []byte("response")
+	})
+	s.core.Respond("/empty", func(request *clouditest.Message) ([]byte, []byte) {
+		return []byte{}, []byte{}
+	})
+	s.core.Respond("/none", func(request *clouditest.Message) ([]byte, []byte) {
+		// no response
+		return nil, nil
+	})
+	s.start(t)
+	prefix := s.api.Prefix()
+	for _, name := range []string{"ok", "fail", "panic"} {
+		_, err = s.core.SendSync(prefix+name, nil, nil)
+		assertNoError(t, err)
+	}
+	_, err = s.core.SendAsync(prefix+"ok", nil, nil)
+	assertNoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, _, _, err = s.api.SendSync("/destination", nil, nil)
+		assertNoError(t, err)
+	}
+	_, _, _, err = s.api.SendSync("/missing", nil, nil)
+	assertNoError(t, err)
+	_, _, _, err = s.api.SendSync("/empty", nil, nil)
+	assertNoError(t, err)
+	// asynchronous service request response timeouts
+	var transId []byte
+	transId, err = s.api.SendAsync("/destination", nil, nil)
+	assertNoError(t, err)
+	_, _, _, err = s.api.RecvAsync(transId)
+	assertNoError(t, err)
+	transId, err = s.api.SendAsync("/none", nil, nil)
+	assertNoError(t, err)
+	_, _, _, err = s.api.RecvAsync(transId, 100)
+	assertNoError(t, err)
+	transId, err = s.api.SendAsync("/none", nil, nil)
+	assertNoError(t, err)
+	_, err = s.api.RecvAsyncs([][]byte{transId}, 100)
+	assertNoError(t, err)
+
+	stats := s.api.Stats()
+	assertEqual(t, 3, len(stats.Patterns), "")
+	assertEqual(t, uint64(1), stats.Patterns[prefix+"ok"].Async, "")
+	assertEqual(t, uint64(1), stats.Patterns[prefix+"ok"].Sync, "")
+	assertEqual(t, uint64(1), stats.Patterns[prefix+"fail"].Errors, "")
+	assertEqual(t, uint64(0), stats.Patterns[prefix+"fail"].Panics, "")
+	assertEqual(t, uint64(1), stats.Patterns[prefix+"panic"].Panics, "")
+	assertEqual(t, uint64(0), stats.Patterns[prefix+"panic"].Errors, "")
+	latency := stats.Patterns[prefix+"ok"].Latency
+	assertEqual(t, uint64(2), latency.Count, "")
+	assertEqual(t, []time.Duration{time.Millisecond, time.Hour}, latency.Buckets, "")
+	assertEqual(t, uint64(2), latency.Counts[1], "")
+	assertEqual(t, uint64(3), stats.Destinations["/destination"].Requests, "")
+	assertEqual(t, uint64(0), stats.Destinations["/destination"].Timeouts, "")
+	assertEqual(t, uint64(2), stats.Destinations["/destination"].Latency.Count, "")
+	assertEqual(t, uint64(1), stats.Destinations["/missing"].Timeouts, "")
+	assertEqual(t, uint64(0), stats.Destinations["/empty"].Timeouts, "")
+	assertEqual(t, uint64(1), stats.Destinations["/empty"].Latency.Count, "")
+	assertEqual(t, uint64(2), stats.RecvTimeouts, "")
+
+	recorder := httptest.NewRecorder()
+	metrics.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	assertEqual(t, "text/plain; version=0.0.4; charset=utf-8", recorder.Header().Get("Content-Type"), "")
+	exposition := recorder.Body.String()
+	for _, line := range []string{
+		"# TYPE cloudi_requests_total counter\n",
+		"cloudi_requests_total{pattern=\"" + prefix + "ok\",type=\"sync\"} 1\n",
+		"cloudi_request_errors_total{pattern=\"" + prefix + "fail\"} 1\n",
+		"cloudi_request_panics_total{pattern=\"" + prefix + "panic\"} 1\n",
+		"cloudi_request_duration_seconds_bucket{pattern=\"" + prefix + "ok\",le=\"3600\"} 2\n",
+		"cloudi_request_duration_seconds_bucket{pattern=\"" + prefix + "ok\",le=\"+Inf\"} 2\n",
+		"cloudi_request_duration_seconds_count{pattern=\"" + prefix + "ok\"} 2\n",
+		"cloudi_send_total{name=\"/destination\"} 3\n",
+		"cloudi_send_timeouts_total{name=\"/missing\"} 1\n",
+		"cloudi_recv_async_timeouts_total 2\n",
+		"cloudi_send_duration_seconds_count{name=\"/destination\"} 2\n",
+	} {
+		assertEqual(t, true, strings.Contains(exposition, line), line)
+	}
+
+	// service names after the maximum share a single destination
+	metrics, err = cloudi.MetricsNew()
+	assertNoError(t, err)
+	assertEqual(t, true, errors.Is(metrics.DestinationsMaxSet(-1), cloudi.ErrInvalidInput), "")
+	assertNoError(t, metrics.DestinationsMaxSet(1))
+	s.api.MetricsSet(metrics)
+	for _, name := range []string{"/destination", "/missing", "/empty", "/destination"} {
+		_, _, _, err = s.api.SendSync(name, nil, nil)
+		assertNoError(t, err)
+	}
+	stats = s.api.Stats()
+	assertEqual(t, 2, len(stats.Destinations), "")
+	assertEqual(t, uint64(2), stats.Destinations["/destination"].Requests, "")
+	assertEqual(t, uint64(2), stats.Destinations[cloudi.MetricsDestinationOther].Requests, "")
+	assertEqual(t, uint64(1), stats.Destinations[cloudi.MetricsDestinationOther].Timeouts, "")
+	s.stop(t)
+}
+
+func TestTrace(t *testing.T) {
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	trace, err := cloudi.TraceContextParse(traceparent, " congo=t61rcWkgMzE ")
+	assertNoError(t, err)
+	assertEqual(t, traceparent, trace.TraceParent(), "")
+	assertEqual(t, "congo=t61rcWkgMzE", trace.State, "")
+	assertEqual(t, byte(1), trace.Flags, "")
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-00",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	} {
+		_, err = cloudi.TraceContextParse(invalid, "")
+		assertEqual(t, true, errors.Is(err, cloudi.ErrInvalidInput), invalid)
+	}
+
+	exporter := &cloudi.TraceMemoryExporter{}
+	s := serviceNew(t, clouditest.ConfigDefault(), nil)
+	s.api.TraceExporterSet(exporter)
+	downstream := make(chan []byte, 4)
+	s.core.Respond("/downstream", func(request *clouditest.Message) ([]byte, []byte) {
+		downstream <- request.RequestInfo
+		return nil, []byte("response")
+	})
+	traced := func(request *cloudi.Request) (*cloudi.Response, error) {
+		_, _, _, err := request.SendSync("/downstream", nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		_, _, _, err = request.SendSync("/downstream", []byte("binary"), nil)
+		if err != nil {
+			return nil, err
+		}
+		return nil, errors.New("traced")
+	}
+	forward := func(request *cloudi.Request) (*cloudi.Response, error) {
+		_, _, err := request.API().ForwardTo(request.RequestType, "/next", request.RequestInfo, request.Request, request.Timeout, request.Priority, request.TransId, request.Source)
+		return nil, err
+	}
+	assertNoError(t, s.api.SubscribeHandler("traced", cloudi.HandlerFunc(traced)))
+	assertNoError(t, s.api.SubscribeHandler("forward", cloudi.HandlerFunc(forward)))
+	blocked := make(chan struct{})
+	release := make(chan struct{})
+	block := func(request *cloudi.Request) (*cloudi.Response, error) {
+		close(blocked)
+		<-release
+		return &cloudi.Response{Response: []byte("released")}, nil
+	}
+	assertNoError(t, s.api.SubscribeHandler("block", cloudi.HandlerFunc(block)))
+	s.start(t)
+	prefix := s.api.Prefix()
+	requestInfo, err := cloudi.InfoKeyValueNew(map[string][]string{
+		cloudi.InfoKeyTraceParent: {traceparent},
+		cloudi.InfoKeyTraceState:  {"congo=t61rcWkgMzE"},
+	})
+	assertNoError(t, err)
+	_, err = s.core.SendSync(prefix+"traced", requestInfo, nil)
+	assertNoError(t, err)
+	spans := exporter.Spans()
+	assertEqual(t, 1, len(spans), "")
+	span := spans[0]
+	assertEqual(t, trace.TraceId, span.Context.TraceId, "")
+	assertEqual(t, trace.SpanId, span.Parent.SpanId, "")
+	assertEqual(t, false, span.Context.SpanId == trace.SpanId, "")
+	assertEqual(t, "congo=t61rcWkgMzE", span.Context.State, "")
+	assertEqual(t, prefix+"traced", span.Pattern, "")
+	assertEqual(t, cloudi.SYNC, span.RequestType, "")
+	assertEqual(t, "traced", span.Err.Error(), "")
+	assertEqual(t, true, !span.End.Before(span.Start), "")
+	info := cloudi.InfoKeyValueParse(<-downstream)
+	assertEqual(t, []string{span.Context.TraceParent()}, info[cloudi.InfoKeyTraceParent], "")
+	assertEqual(t, []string{"congo=t61rcWkgMzE"}, info[cloudi.InfoKeyTraceState], "")
+	// request info that is not key/value data is not modified
+	assertEqual(t, []byte("binary"), <-downstream, "")
+
+	// a forward continues the trace
+	exporter.Reset()
+	var result *clouditest.Result
+	result, err = s.core.SendSync(prefix+"forward", nil, nil)
+	assertNoError(t, err)
+	assertEqual(t, true, result.Forwarded(), "")
+	// the Span ends after the forward is sent
+	for i := 0; i < 100 && len(exporter.Spans()) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	spans = exporter.Spans()
+	assertEqual(t, 1, len(spans), "")
+	assertEqual(t, true, spans[0].Parent.IsZero(), "")
+	assertEqual(t, true, spans[0].Err == nil, "")
+	info = cloudi.InfoKeyValueParse(result.RequestInfo)
+	assertEqual(t, []string{spans[0].Context.TraceParent()}, info[cloudi.InfoKeyTraceParent], "")
+
+	// a send from a different goroutine while a Handler executes
+	// is not part of the trace
+	blockResult := make(chan error, 1)
+	go func() {
+		_, err := s.core.SendSync(prefix+"block", requestInfo, nil)
+		blockResult <- err
+	}()
+	<-blocked
+	_, _, _, err = s.api.SendSync("/downstream", nil, nil)
+	assertNoError(t, err)
+	info = cloudi.InfoKeyValueParse(<-downstream)
+	assertEqual(t, 0, len(info[cloudi.InfoKeyTraceParent]), "")
+	close(release)
+	assertNoError(t, <-blockResult)
+	s.stop(t)
+}
+
+func TestTimeoutError(t *testing.T) {
+	s := serviceNew(t, clouditest.ConfigDefault(), nil)
+	s.core.Respond("/empty", func(request *clouditest.Message) ([]byte, []byte) {
+		return []byte{}, []byte{}
+	})
+	s.core.Respond("/none", func(request *clouditest.Message) ([]byte, []byte) {
+		// no response
+		return nil, nil
+	})
+	ctx := context.Background()
+	_, _, transId, err := s.api.SendSyncOptions(ctx, "/missing", nil, nil)
+	assertNoError(t, err)
+	assertEqual(t, make([]byte, 16), transId, "")
+	_, _, _, err = s.api.SendSyncOptions(ctx, "/missing", nil, nil, cloudi.WithTimeout(250*time.Millisecond), cloudi.WithTimeoutError())
+	assertEqual(t, true, errors.Is(err, cloudi.ErrTimeout), "")
+	var timeoutError *cloudi.TimeoutError
+	assertEqual(t, true, errors.As(err, &timeoutError), "")
+	assertEqual(t, "/missing", timeoutError.Name, "")
+	assertEqual(t, uint32(250), timeoutError.Timeout, "")
+	// a destination that does not respond before the timeout
+	var response []byte
+	_, response, transId, err = s.api.SendSyncOptions(ctx, "/none", nil, nil, cloudi.WithTimeout(200*time.Millisecond))
+	assertNoError(t, err)
+	assertEqual(t, 0, len(response), "")
+	assertEqual(t, true, bytes.Equal(make([]byte, 16), transId), "")
+	_, _, _, err = s.api.SendSyncOptions(ctx, "/none", nil, nil, cloudi.WithTimeout(200*time.Millisecond), cloudi.WithTimeoutError())
+	assertEqual(t, true, errors.Is(err, cloudi.ErrTimeout), "")
+	assertEqual(t, true, errors.As(err, &timeoutError), "")
+	assertEqual(t, "/none", timeoutError.Name, "")
+	assertEqual(t, uint32(200), timeoutError.Timeout, "")
+	// an empty response is not a timeout
+	_, response, transId, err = s.api.SendSyncOptions(ctx, "/empty", nil, nil, cloudi.WithTimeoutError())
+	assertNoError(t, err)
+	assertEqual(t, 0, len(response), "")
+	assertEqual(t, false, bytes.Equal(make([]byte, 16), transId), "")
+
+	_, err = s.api.McastAsyncOptions(ctx, "/missing", nil, nil, cloudi.WithTimeoutError())
+	assertEqual(t, true, errors.Is(err, cloudi.ErrNoDestination), "")
+	assertEqual(t, false, errors.Is(err, cloudi.ErrTimeout), "")
+	var transIds [][]byte
+	transIds, err = s.api.McastAsyncOptions(ctx, "/missing", nil, nil)
+	assertNoError(t, err)
+	assertEqual(t, 0, len(transIds), "")
+
+	transId, err = s.api.SendAsync("/none", nil, nil)
+	assertNoError(t, err)
+	_, _, _, err = s.api.RecvAsync(uint32(200), transId, cloudi.WithTimeoutError())
+	assertEqual(t, true, errors.Is(err, cloudi.ErrTimeout), "")
+	assertEqual(t, true, errors.As(err, &timeoutError), "")
+	assertEqual(t, uint32(200), timeoutError.Timeout, "")
+	_, _, _, err = s.api.RecvAsync(uint32(200), transId)
+	assertNoError(t, err)
+	assertNoError(t, s.core.Close())
+}
+
+func TestTransId(t *testing.T) {
+	// RFC 9562 version 1 UUID example
+	transId, err := cloudi.TransIdParse("c232ab00-9414-11ec-b3c8-9f6bdeced846")
+	assertNoError(t, err)
+	assertEqual(t, "c232ab00-9414-11ec-b3c8-9f6bdeced846", transId.String(), "")
+	assertEqual(t, time.Date(2022, 2, 22, 19, 22, 22, 0, time.UTC), transId.Time().UTC(), "")
+	assertEqual(t, false, transId.IsZero(), "")
+	assertEqual(t, true, cloudi.TransId{}.IsZero(), "")
+	assertEqual(t, true, cloudi.TransId{}.Time().IsZero(), "")
+	for _, text := range []string{"", "c232ab00-9414-11ec-b3c8-9f6bdeced84", "c232ab00x9414-11ec-b3c8-9f6bdeced846", "g232ab00-9414-11ec-b3c8-9f6bdeced846"} {
+		_, err = cloudi.TransIdParse(text)
+		_, invalid := err.(*cloudi.InvalidInputError)
+		assertEqual(t, true, invalid, text)
+	}
+	_, err = cloudi.TransIdNew(make([]byte, 15))
+	_, invalid := err.(*cloudi.InvalidInputError)
+	assertEqual(t, true, invalid, "")
+
+	generator, err := cloudi.TransIdGeneratorNew()
+	assertNoError(t, err)
+	start := time.Now().Truncate(time.Microsecond)
+	transId1 := generator.Next()
+	transId2 := generator.Next()
+	assertEqual(t, -1, transId1.Compare(transId2), "")
+	assertEqual(t, 1, transId2.Compare(transId1), "")
+	assertEqual(t, 0, transId1.Compare(transId1), "")
+	assertEqual(t, true, !transId1.Time().Before(start), "")
+	assertEqual(t, true, transId2.Time().Sub(start) < time.Second, "")
+
+	// trans ids provided by the CloudI core
+	s := serviceNew(t, clouditest.ConfigDefault(), nil)
+	s.core.Respond("/trans_id", func(request *clouditest.Message) ([]byte, []byte) {
+		return nil, []byte("response")
+	})
+	var transIdValue []byte
+	_, _, transIdValue, err = s.api.SendSync("/trans_id", nil, nil)
+	assertNoError(t, err)
+	transId, err = cloudi.TransIdNew(transIdValue)
+	assertNoError(t, err)
+	assertEqual(t, true, time.Since(transId.Time()) < time.Second, "")
+	parsed, err := cloudi.TransIdParse(transId.String())
+	assertNoError(t, err)
+	assertEqual(t, transId, parsed, "")
+	assertNoError(t, s.core.Close())
+}
+
+func TestFuture(t *testing.T) {
+	s := serviceNew(t, clouditest.ConfigDefault(), nil)
+	release := make(chan struct{})
+	s.core.Respond("/upper", func(request *clouditest.Message) ([]byte, []byte) {
+		return nil, append([]byte("upper "), request.Request...)
+	})
+	s.core.Respond("/replica", func(request *clouditest.Message) ([]byte, []byte) {
+		<-release
+		return nil, []byte("slow")
+	})
+	s.core.Respond("/replica", func(request *clouditest.Message) ([]byte, []byte) {
+		return nil, []byte("fast")
+	})
+	ctx := context.Background()
+	future, err := s.api.SendAsyncFuture(ctx, "/upper", nil, []byte("future"))
+	assertNoError(t, err)
+	<-future.Done()
+	var response *cloudi.Response
+	response, err = future.Result()
+	assertNoError(t, err)
+	assertEqual(t, []byte("upper future"), response.Response, "")
+	messages := s.core.Messages("send_async")
+	assertEqual(t, 1, len(messages), "")
+	var futures []*cloudi.Future
+	futures, err = s.api.McastAsyncFutures(ctx, "/replica", nil, nil, cloudi.WithTimeout(time.Second))
+	assertNoError(t, err)
+	assertEqual(t, 2, len(futures), "")
+	var i int
+	i, response, err = cloudi.FutureAny(ctx, futures...)
+	assertNoError(t, err)
+	assertEqual(t, 1, i, "")
+	assertEqual(t, []byte("fast"), response.Response, "")
+	ctxWait, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	_, err = futures[0].Wait(ctxWait)
+	cancel()
+	assertEqual(t, context.DeadlineExceeded, err, "")
+	close(release)
+	var responses []*cloudi.Response
+	responses, err = cloudi.FutureAll(ctx, futures...)
+	assertNoError(t, err)
+	assertEqual(t, []byte("slow"), responses[0].Response, "")
+	assertEqual(t, []byte("fast"), responses[1].Response, "")
+	future, err = s.api.SendAsyncFuture(ctx, "/missing", nil, nil, cloudi.WithTimeout(100*time.Millisecond))
+	assertNoError(t, err)
+	i, _, err = cloudi.FutureAny(ctx, future)
+	assertNoError(t, err)
+	assertEqual(t, -1, i, "")
+	assertNoError(t, s.core.Close())
+}
+
+func TestGather(t *testing.T) {
+	s := serviceNew(t, clouditest.ConfigDefault(), nil)
+	release := make(chan struct{})
+	for _, value := range []string{"1", "2", "", "slow"} {
+		value := value
+		s.core.Respond("/replica", func(request *clouditest.Message) ([]byte, []byte) {
+			switch value {
+			case "":
+				return nil, nil
+			case "slow":
+				<-release
+			}
+			return nil, []byte(value)
+		})
+	}
+	sum := func(value int, response *cloudi.Response) (int, error) {
+		number, err := strconv.Atoi(string(response.Response))
+		return value + number, err
+	}
+	ctx := context.Background()
+	result, err := cloudi.Gather(ctx, s.api, "/replica", nil, nil, 2, 0, sum, cloudi.WithTimeout(time.Second))
+	assertNoError(t, err)
+	assertEqual(t, 3, result.Value, "")
+	assertEqual(t, 2, result.Responses, "")
+	assertEqual(t, 4, len(result.Replicas), "")
+	assertEqual(t, cloudi.GatherResponse, result.Replicas[0].Status, "")
+	assertEqual(t, cloudi.GatherResponse, result.Replicas[1].Status, "")
+	assertEqual(t, cloudi.GatherPending, result.Replicas[3].Status, "")
+	result, err = cloudi.Gather(ctx, s.api, "/replica", nil, nil, 0, 0, sum, cloudi.WithTimeout(200*time.Millisecond))
+	quorumError, ok := err.(*cloudi.QuorumError)
+	assertEqual(t, true, ok, "")
+	assertEqual(t, 4, quorumError.Required, "")
+	assertEqual(t, 2, quorumError.Responses, "")
+	assertEqual(t, 3, result.Value, "")
+	assertEqual(t, cloudi.GatherTimeout, result.Replicas[2].Status, "")
+	assertEqual(t, cloudi.GatherTimeout, result.Replicas[3].Status, "")
+	close(release)
+	_, err = cloudi.Gather(ctx, s.api, "/replica", nil, nil, 5, 0, sum)
+	_, ok = err.(*cloudi.QuorumError)
+	assertEqual(t, true, ok, "")
+	assertNoError(t, s.core.Close())
+}
+
+func TestRetry(t *testing.T) {
+	s := serviceNew(t, clouditest.ConfigDefault(), nil)
+	var lock sync.Mutex
+	attempts := 0
+	s.core.Respond("/flaky", func(request *clouditest.Message) ([]byte, []byte) {
+		lock.Lock()
+		defer lock.Unlock()
+		attempts++
+		if attempts < 3 {
+			return nil, nil
+		}
+		return nil, []byte(cloudi.InfoKeyValueParse(request.RequestInfo)[cloudi.InfoKeyAttempt][0])
+	})
+	s.core.Respond("/busy", func(request *clouditest.Message) ([]byte, []byte) {
+		responseInfo, _ := cloudi.InfoKeyValueNew(map[string][]string{"status": {"busy"}})
+		return responseInfo, []byte("busy")
+	})
+	policy := cloudi.RetryPolicy{Attempts: 3, Backoff: time.Millisecond, Jitter: 0.5}
+	ctx := context.Background()
+	_, response, _, err := s.api.SendSyncOptions(ctx, "/flaky", nil, nil, cloudi.WithRetry(policy))
+	assertNoError(t, err)
+	assertEqual(t, []byte("3"), response, "")
+	messages := s.core.Messages("send_sync")
+	assertEqual(t, 3, len(messages), "")
+	for i, message := range messages {
+		assertEqual(t, []string{strconv.Itoa(i + 1)}, cloudi.InfoKeyValueParse(message.RequestInfo)[cloudi.InfoKeyAttempt], "")
+		assertEqual(t, true, message.Timeout <= 5000, "")
+	}
+	// the attempts are limited by the service request timeout
+	policy = cloudi.RetryPolicy{Attempts: 10, Backoff: 40 * time.Millisecond, Retry: cloudi.RetryInfoKey("status", "busy")}
+	start := time.Now()
+	_, response, _, err = s.api.SendSyncOptions(ctx, "/busy", nil, nil, cloudi.WithRetry(policy), cloudi.WithTimeout(100*time.Millisecond))
+	assertNoError(t, err)
+	assertEqual(t, []byte("busy"), response, "")
+	assertEqual(t, true, time.Since(start) < time.Second, "")
+	busy := len(s.core.Messages("send_sync")) - 3
+	assertEqual(t, true, busy >= 2 && busy < 10, "")
+	policy = cloudi.RetryPolicy{Attempts: 2, AttemptTimeout: 50 * time.Millisecond}
+	var transId []byte
+	transId, err = s.api.SendAsyncOptions(ctx, "/missing", nil, nil, cloudi.WithRetry(policy))
+	assertNoError(t, err)
+	assertEqual(t, make([]byte, 16), transId, "")
+	messages = s.core.Messages("send_async")
+	assertEqual(t, 2, len(messages), "")
+	assertEqual(t, uint32(50), messages[1].Timeout, "")
+	var transIds [][]byte
+	transIds, err = s.api.McastAsyncOptions(ctx, "/missing", nil, nil, cloudi.WithRetry(policy))
+	assertNoError(t, err)
+	assertEqual(t, 0, len(transIds), "")
+	assertEqual(t, 2, len(s.core.Messages("mcast_async")), "")
+	transIds, err = s.api.McastAsyncOptions(ctx, "/busy", nil, nil, cloudi.WithRetry(policy))
+	assertNoError(t, err)
+	assertEqual(t, 1, len(transIds), "")
+	assertEqual(t, 3, len(s.core.Messages("mcast_async")), "")
+	_, err = s.api.SendAsyncOptions(ctx, "/missing", nil, nil, cloudi.WithRetry(cloudi.RetryPolicy{}))
+	_, invalid := err.(*cloudi.InvalidInputError)
+	assertEqual(t, true, invalid, "")
+	// RecvAsync only accepts the timeout options
+	_, _, _, err = s.api.RecvAsync(transIds[0], cloudi.WithRetry(policy))
+	assertEqual(t, true, errors.Is(err, cloudi.ErrInvalidInput), "")
+	_, _, _, err = s.api.RecvAsync(transIds[0], cloudi.WithPriority(cloudi.PriorityHigh))
+	assertEqual(t, true, errors.Is(err, cloudi.ErrInvalidInput), "")
+	assertNoError(t, s.core.Close())
+}
+
+func TestBreaker(t *testing.T) {
+	s := serviceNew(t, clouditest.ConfigDefault(), nil)
+	var lock sync.Mutex
+	healthy := false
+	for _, name := range []string{"/db/1", "/db/2"} {
+		s.core.Respond(name, func(request *clouditest.Message) ([]byte, []byte) {
+			lock.Lock()
+			defer lock.Unlock()
+			if !healthy {
+				return nil, nil
+			}
+			return nil, []byte("ok")
+		})
+	}
+	var changes []string
+	breaker, err := cloudi.BreakerNew(cloudi.BreakerPolicy{
+		Failures:    2,
+		OpenTimeout: 50 * time.Millisecond,
+		Patterns:    []string{"/db/*"},
+		Changed: func(destination string, from, to cloudi.BreakerState) {
+			lock.Lock()
+			changes = append(changes, destination+" "+from.String()+" "+to.String())
+			lock.Unlock()
+		},
+	})
+	assertNoError(t, err)
+	ctx := context.Background()
+	option := cloudi.WithBreaker(breaker)
+	for _, name := range []string{"/db/1", "/db/2"} {
+		_, _, _, err = s.api.SendSyncOptions(ctx, name, nil, nil, option)
+		assertNoError(t, err)
+	}
+	assertEqual(t, cloudi.BreakerOpen, breaker.State("/db/1"), "")
+	_, _, _, err = s.api.SendSyncOptions(ctx, "/db/2", nil, nil, option)
+	openError, ok := err.(*cloudi.BreakerOpenError)
+	assertEqual(t, true, ok, "")
+	assertEqual(t, "/db/*", openError.Destination, "")
+	assertEqual(t, true, errors.Is(err, cloudi.ErrBreakerOpen), "")
+	assertEqual(t, 2, len(s.core.Messages("send_sync")), "")
+	// an open circuit also stops McastAsync
+	_, err = s.api.McastAsyncOptions(ctx, "/db/1", nil, nil, option)
+	assertEqual(t, true, errors.Is(err, cloudi.ErrBreakerOpen), "")
+	assertEqual(t, 0, len(s.core.Messages("mcast_async")), "")
+	// a separate destination is not affected
+	_, err = s.api.SendAsyncOptions(ctx, "/upper", nil, nil, option, cloudi.WithTimeout(10*time.Millisecond))
+	assertNoError(t, err)
+	assertEqual(t, cloudi.BreakerClosed, breaker.State("/upper"), "")
+	time.Sleep(60 * time.Millisecond)
+	assertEqual(t, cloudi.BreakerHalfOpen, breaker.State("/db/1"), "")
+	// a cancelled trial is neither a success nor a failure
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, _, _, err = s.api.SendSyncOptions(cancelled, "/db/1", nil, nil, option)
+	assertEqual(t, true, errors.Is(err, context.Canceled), "")
+	assertEqual(t, cloudi.BreakerHalfOpen, breaker.State("/db/1"), "")
+	lock.Lock()
+	healthy = true
+	lock.Unlock()
+	var response []byte
+	_, response, _, err = s.api.SendSyncOptions(ctx, "/db/1", nil, nil, option)
+	assertNoError(t, err)
+	assertEqual(t, []byte("ok"), response, "")
+	assertEqual(t, cloudi.BreakerClosed, breaker.State("/db/2"), "")
+	lock.Lock()
+	assertEqual(t, []string{
+		"/db/* closed open",
+		"/db/* open half-open",
+		"/db/* half-open closed",
+	}, changes, "")
+	lock.Unlock()
+	// McastAsync without destinations is a failure
+	breaker, err = cloudi.BreakerNew(cloudi.BreakerPolicy{Failures: 1, OpenTimeout: time.Minute})
+	assertNoError(t, err)
+	_, err = s.api.McastAsyncOptions(ctx, "/missing", nil, nil, cloudi.WithBreaker(breaker))
+	assertNoError(t, err)
+	assertEqual(t, cloudi.BreakerOpen, breaker.State("/missing"), "")
+	_, _, _, err = s.api.RecvAsync(uint32(10), cloudi.WithBreaker(breaker))
+	assertEqual(t, true, errors.Is(err, cloudi.ErrInvalidInput), "")
+	assertNoError(t, s.core.Close())
+}
+
+func TestSendSyncHedged(t *testing.T) {
+	s := serviceNew(t, clouditest.ConfigDefault(), nil)
+	var lock sync.Mutex
+	count := 0
+	s.core.Respond("/read", func(request *clouditest.Message) ([]byte, []byte) {
+		lock.Lock()
+		count++
+		first := count == 1
+		lock.Unlock()
+		if first {
+			// the first service request has a long latency
+			time.Sleep(300 * time.Millisecond)
+			return nil, []byte("slow")
+		}
+		return nil, []byte("fast")
+	})
+	hedge := &cloudi.Hedge{Delay: 20 * time.Millisecond}
+	ctx := context.Background()
+	start := time.Now()
+	_, response, transId, err := s.api.SendSyncHedged(ctx, "/read", nil, nil, hedge)
+	assertNoError(t, err)
+	assertEqual(t, []byte("fast"), response, "")
+	assertEqual(t, true, time.Since(start) < 300*time.Millisecond, "")
+	messages := s.core.Messages("send_async")
+	assertEqual(t, 2, len(messages), "")
+	assertEqual(t, true, messages[1].Timeout < messages[0].Timeout, "")
+	// the slow response is received by the abandoned service request
+	_, response, _, err = s.api.RecvAsync(uint32(500))
+	assertNoError(t, err)
+	assertEqual(t, []byte{}, response, "")
+	assertEqual(t, false, reflect.DeepEqual(make([]byte, 16), transId), "")
+	_, response, transId, err = s.api.SendSyncHedged(ctx, "/missing", nil, nil, hedge, cloudi.WithTimeout(100*time.Millisecond))
+	assertNoError(t, err)
+	assertEqual(t, []byte{}, response, "")
+	assertEqual(t, make([]byte, 16), transId, "")
+	_, _, _, err = s.api.SendSyncHedged(ctx, "/missing", nil, nil, hedge, cloudi.WithTimeout(100*time.Millisecond), cloudi.WithTimeoutError())
+	assertEqual(t, true, errors.Is(err, cloudi.ErrTimeout), "")
+	// an empty response is followed by a duplicate without the delay
+	empty := true
+	s.core.Respond("/empty", func(request *clouditest.Message) ([]byte, []byte) {
+		lock.Lock()
+		defer lock.Unlock()
+		if empty {
+			empty = false
+			return []byte{}, []byte{}
+		}
+		return nil, []byte("duplicate")
+	})
+	start = time.Now()
+	_, response, _, err = s.api.SendSyncHedged(ctx, "/empty", nil, nil, &cloudi.Hedge{Delay: time.Second})
+	assertNoError(t, err)
+	assertEqual(t, []byte("duplicate"), response, "")
+	assertEqual(t, true, time.Since(start) < time.Second, "")
+	assertNoError(t, s.core.Close())
+}
+
+func TestDeadline(t *testing.T) {
+	s := serviceNew(t, clouditest.ConfigDefault(), nil)
+	s.core.Respond("/upper", func(request *clouditest.Message) ([]byte, []byte) {
+		return nil, append([]byte("upper "), request.Request...)
+	})
+	assertNoError(t, s.api.SubscribeHandler("nested", cloudi.HandlerFunc(func(request *cloudi.Request) (*cloudi.Response, error) {
+		assertEqual(t, true, time.Until(request.Deadline()) <= 200*time.Millisecond, "")
+		_, err := request.McastAsync("/upper", nil, request.Request)
+		assertNoError(t, err)
+		_, err = request.SendAsync("/upper", nil, request.Request)
+		assertNoError(t, err)
+		// a send without the Request is not limited
+		_, err = request.API().SendAsync("/upper", nil, request.Request)
+		assertNoError(t, err)
+		_, response, _, err := request.SendSync("/upper", nil, request.Request)
+		return &cloudi.Response{Response: response}, err
+	})))
+	assertNoError(t, s.api.SubscribeHandler("forward", cloudi.HandlerFunc(func(request *cloudi.Request) (*cloudi.Response, error) {
+		time.Sleep(50 * time.Millisecond)
+		return request.Forward("/destination", nil, request.Request, request.Timeout, request.Priority)
+	})))
+	assertNoError(t, s.api.SubscribeHandler("expired", cloudi.HandlerFunc(func(request *cloudi.Request) (*cloudi.Response, error) {
+		<-request.Context().Done()
+		_, _, _, err := request.SendSync("/upper", nil, request.Request)
+		assertEqual(t, context.DeadlineExceeded, err, "")
+		api := request.API()
+		api.Forward(request.RequestType, "/destination", nil, request.Request, request.Timeout, request.Priority, request.TransId, request.Source)
+		return nil, nil
+	})))
+	s.start(t)
+	result, err := s.core.Send(clouditest.Request{RequestType: cloudi.SYNC, Name: "/nested", Request: []byte("nested"), Timeout: 200})
+	assertNoError(t, err)
+	assertEqual(t, []byte("upper nested"), result.Response, "")
+	messages := s.core.Messages("send_sync")
+	assertEqual(t, 1, len(messages), "")
+	assertEqual(t, true, messages[0].Timeout <= 200, "")
+	messages = s.core.Messages("mcast_async")
+	assertEqual(t, 1, len(messages), "")
+	assertEqual(t, true, messages[0].Timeout <= 200, "")
+	messages = s.core.Messages("send_async")
+	assertEqual(t, 2, len(messages), "")
+	assertEqual(t, true, messages[0].Timeout <= 200, "")
+	assertEqual(t, s.api.TimeoutAsync(), messages[1].Timeout, "")
+	result, err = s.core.Send(clouditest.Request{RequestType: cloudi.ASYNC, Name: "/forward", Timeout: 200})
+	assertNoError(t, err)
+	assertEqual(t, true, result.Forwarded(), "")
+	assertEqual(t, true, result.Timeout <= 150, "")
+	// a forward is not sent without time remaining
+	// (the fake CloudI core does not wait for a late response)
+	_, _ = s.core.Send(clouditest.Request{RequestType: cloudi.SYNC, Name: "/expired", Timeout: 20})
+	for i := 0; i < 100 && len(s.core.Messages("return_sync")) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	messages = s.core.Messages("return_sync")
+	assertEqual(t, 2, len(messages), "")
+	assertEqual(t, "/expired", messages[1].Name, "")
+	assertEqual(t, []byte{}, messages[1].Response, "")
+	assertEqual(t, 0, len(s.core.Messages("forward_sync")), "")
+	assertEqual(t, 1, len(s.core.Messages("send_sync")), "")
+	s.stop(t)
+}
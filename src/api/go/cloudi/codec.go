@@ -0,0 +1,442 @@
+package cloudi
+
+//-*-Mode:Go;coding:utf-8;tab-width:4;c-basic-offset:4-*-
+// ex: set ft=go fenc=utf-8 sts=4 ts=4 sw=4 noet nomod:
+//
+// MIT License
+//
+// Copyright (c) 2017-2020 Michael Truog <mjtruog at protonmail dot com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+// DEALINGS IN THE SOFTWARE.
+//
+
+import (
+	"context"
+	"encoding/json"
+	"erlang"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"sync"
+)
+
+// InfoKeyCodec is the request info (or response info) key that provides
+// the name of the Codec used for the request (or response) data
+const InfoKeyCodec = "codec"
+
+// Codec encodes and decodes service request and response data
+type Codec interface {
+	// Name is provided in the request info to select the Codec used
+	// by the receiver
+	Name() string
+	Marshal(value interface{}) ([]byte, error)
+	Unmarshal(data []byte, value interface{}) error
+}
+
+var (
+	// CodecJSON encodes data as JSON
+	CodecJSON Codec = codecJSON{}
+	// CodecErlang encodes data in the Erlang Binary Term Format
+	// (decoded as the erlang package types, a numeric type, *big.Int,
+	// []byte or string, but not a struct)
+	CodecErlang Codec = codecErlang{}
+	// CodecRaw uses []byte or string data without any encoding
+	CodecRaw Codec = codecRaw{}
+)
+
+var codecs = map[string]Codec{
+	CodecJSON.Name():   CodecJSON,
+	CodecErlang.Name(): CodecErlang,
+	CodecRaw.Name():    CodecRaw,
+}
+var codecsLock sync.RWMutex
+
+// CodecRegister makes a Codec available by name to a receiver
+func CodecRegister(codec Codec) error {
+	if codec == nil || codec.Name() == "" {
+		return invalidInputErrorNew("codec")
+	}
+	codecsLock.Lock()
+	codecs[codec.Name()] = codec
+	codecsLock.Unlock()
+	return nil
+}
+
+// CodecLookup returns the Codec registered with the name
+func CodecLookup(name string) (Codec, bool) {
+	codecsLock.RLock()
+	codec, found := codecs[name]
+	codecsLock.RUnlock()
+	return codec, found
+}
+
+// codecInfo returns the Codec named in the info key/value data
+// (or the default Codec if a name is not provided)
+func codecInfo(info []byte, codecDefault Codec) (Codec, error) {
+	if len(info) == 0 {
+		return codecDefault, nil
+	}
+	names := InfoKeyValueParse(info)[InfoKeyCodec]
+	if len(names) == 0 {
+		return codecDefault, nil
+	}
+	codec, found := CodecLookup(names[0])
+	if !found {
+		return nil, codecErrorNew(names[0], nil)
+	}
+	return codec, nil
+}
+
+// codecInfoNew returns the info key/value data that names the Codec
+func codecInfoNew(codec Codec) ([]byte, error) {
+	return InfoKeyValueNew(map[string][]string{InfoKeyCodec: {codec.Name()}})
+}
+
+func codecMarshal(codec Codec, value interface{}) ([]byte, []byte, error) {
+	data, err := codec.Marshal(value)
+	if err != nil {
+		return nil, nil, codecErrorNew(codec.Name(), err)
+	}
+	var info []byte
+	info, err = codecInfoNew(codec)
+	if err != nil {
+		return nil, nil, err
+	}
+	return info, data, nil
+}
+
+func codecUnmarshal(codec Codec, data []byte, value interface{}) error {
+	err := codec.Unmarshal(data, value)
+	if err != nil {
+		var codecError *CodecError
+		if errors.As(err, &codecError) {
+			return err
+		}
+		return codecErrorNew(codec.Name(), err)
+	}
+	return nil
+}
+
+// SubscribeTyped subscribes to a service name pattern with a function that
+// is provided the decoded request data and returns the response value.
+// The request is decoded with the Codec named in the request info,
+// if one is provided, and the response is encoded with the same Codec.
+func SubscribeTyped[Req, Resp any](api *Instance, pattern string, codec Codec, function func(request *Request, value Req) (Resp, error)) error {
+	if codec == nil {
+		return invalidInputErrorNew("codec")
+	}
+	if function == nil {
+		return invalidInputErrorNew("function")
+	}
+	return api.SubscribeHandler(pattern, HandlerFunc(func(request *Request) (*Response, error) {
+		codecRequest, err := codecInfo(request.RequestInfo, codec)
+		if err != nil {
+			return nil, err
+		}
+		var value Req
+		err = codecUnmarshal(codecRequest, request.Request, &value)
+		if err != nil {
+			return nil, err
+		}
+		var result Resp
+		result, err = function(request, value)
+		if err != nil {
+			return nil, err
+		}
+		var responseInfo, response []byte
+		responseInfo, response, err = codecMarshal(codecRequest, result)
+		if err != nil {
+			return nil, err
+		}
+		return &Response{ResponseInfo: responseInfo, Response: response}, nil
+	}))
+}
+
+// SendAsyncTyped sends an asynchronous service request with
+// the request value encoded by the Codec
+func SendAsyncTyped[Req any](ctx context.Context, api *Instance, name string, codec Codec, request Req, options ...SendOption) ([]byte, error) {
+	if codec == nil {
+		return nil, invalidInputErrorNew("codec")
+	}
+	requestInfo, requestData, err := codecMarshal(codec, request)
+	if err != nil {
+		return nil, err
+	}
+	return api.SendAsyncOptions(ctx, name, requestInfo, requestData, options...)
+}
+
+// SendSyncTyped sends a synchronous service request with the request value
+// encoded by the Codec and returns the decoded response value
+// (a timeout provides the zero value, like the empty response of SendSync)
+func SendSyncTyped[Req, Resp any](ctx context.Context, api *Instance, name string, codec Codec, request Req, options ...SendOption) (Resp, []byte, error) {
+	var result Resp
+	if codec == nil {
+		return result, nil, invalidInputErrorNew("codec")
+	}
+	requestInfo, requestData, err := codecMarshal(codec, request)
+	if err != nil {
+		return result, nil, err
+	}
+	var responseInfo, response, transId []byte
+	responseInfo, response, transId, err = api.SendSyncOptions(ctx, name, requestInfo, requestData, options...)
+	if err != nil {
+		return result, transId, err
+	}
+	result, err = ResponseDecode[Resp](codec, responseInfo, response)
+	return result, transId, err
+}
+
+// ResponseDecode decodes the response value of a service request
+// (e.g., the response provided by RecvAsync after SendAsyncTyped)
+// with the Codec named in the response info or the Codec provided
+func ResponseDecode[Resp any](codec Codec, responseInfo, response []byte) (Resp, error) {
+	var result Resp
+	if codec == nil {
+		return result, invalidInputErrorNew("codec")
+	}
+	if len(response) == 0 {
+		return result, nil
+	}
+	codecResponse, err := codecInfo(responseInfo, codec)
+	if err != nil {
+		return result, err
+	}
+	err = codecUnmarshal(codecResponse, response, &result)
+	return result, err
+}
+
+type codecJSON struct {
+}
+
+func (codec codecJSON) Name() string {
+	return "json"
+}
+func (codec codecJSON) Marshal(value interface{}) ([]byte, error) {
+	return json.Marshal(value)
+}
+func (codec codecJSON) Unmarshal(data []byte, value interface{}) error {
+	return json.Unmarshal(data, value)
+}
+
+type codecErlang struct {
+}
+
+func (codec codecErlang) Name() string {
+	return "erlang"
+}
+func (codec codecErlang) Marshal(value interface{}) ([]byte, error) {
+	return erlang.TermToBinary(value, -1)
+}
+func (codec codecErlang) Unmarshal(data []byte, value interface{}) error {
+	term, err := erlang.BinaryToTerm(data)
+	if err != nil {
+		return err
+	}
+	if binary, ok := term.(erlang.OtpErlangBinary); ok && binary.Bits == 8 {
+		term = binary.Value
+	}
+	return codecAssign(codec.Name(), term, value)
+}
+
+type codecRaw struct {
+}
+
+func (codec codecRaw) Name() string {
+	return "raw"
+}
+func (codec codecRaw) Marshal(value interface{}) ([]byte, error) {
+	switch data := value.(type) {
+	case []byte:
+		return data, nil
+	case string:
+		return []byte(data), nil
+	default:
+		return nil, invalidInputErrorNew("value")
+	}
+}
+func (codec codecRaw) Unmarshal(data []byte, value interface{}) error {
+	switch result := value.(type) {
+	case *[]byte:
+		*result = data
+		return nil
+	case *string:
+		*result = string(data)
+		return nil
+	default:
+		return codecAssign(codec.Name(), data, value)
+	}
+}
+
+// codecAssign stores a decoded value with a pointer of a compatible type
+// (a numeric value must be exactly represented by the numeric type)
+func codecAssign(codec string, decoded interface{}, value interface{}) error {
+	pointer := reflect.ValueOf(value)
+	if pointer.Kind() != reflect.Ptr || pointer.IsNil() {
+		return invalidInputErrorNew("value")
+	}
+	target := pointer.Elem()
+	if decoded == nil {
+		target.Set(reflect.Zero(target.Type()))
+		return nil
+	}
+	source := reflect.ValueOf(decoded)
+	if source.Type().AssignableTo(target.Type()) {
+		target.Set(source)
+		return nil
+	}
+	if target.Type() == codecBigIntType && codecNumeric(source.Kind()) {
+		bignum, ok := codecBigInt(source)
+		if !ok {
+			return codecErrorNew(codec, codecRepresentationError(source, target))
+		}
+		target.Set(reflect.ValueOf(bignum))
+		return nil
+	}
+	if bignum, ok := decoded.(*big.Int); ok && codecNumeric(target.Kind()) {
+		switch {
+		case bignum.IsInt64():
+			source = reflect.ValueOf(bignum.Int64())
+		case bignum.IsUint64():
+			source = reflect.ValueOf(bignum.Uint64())
+		default:
+			return codecErrorNew(codec, codecRepresentationError(source, target))
+		}
+	}
+	if codecConvertible(source.Type(), target.Type()) {
+		if !codecRepresentable(source, target) {
+			return codecErrorNew(codec, codecRepresentationError(source, target))
+		}
+		target.Set(source.Convert(target.Type()))
+		return nil
+	}
+	return codecErrorNew(codec, fmt.Errorf("%s can not be stored as %s", source.Type(), target.Type()))
+}
+
+var codecBigIntType = reflect.TypeOf((*big.Int)(nil))
+
+// codecBigInt provides an integer value as a *big.Int
+func codecBigInt(source reflect.Value) (*big.Int, bool) {
+	switch {
+	case codecInt(source.Kind()):
+		return big.NewInt(source.Int()), true
+	case codecUint(source.Kind()):
+		return new(big.Int).SetUint64(source.Uint()), true
+	default:
+		value := source.Float()
+		if value != math.Trunc(value) || math.IsInf(value, 0) {
+			return nil, false
+		}
+		bignum, _ := big.NewFloat(value).Int(nil)
+		return bignum, true
+	}
+}
+
+// codecConvertible allows a numeric decoded value to be stored as any
+// numeric type and binary data to be stored as a string
+func codecConvertible(source, target reflect.Type) bool {
+	if codecNumeric(source.Kind()) && codecNumeric(target.Kind()) {
+		return true
+	}
+	return source.Kind() == reflect.Slice &&
+		source.Elem().Kind() == reflect.Uint8 &&
+		target.Kind() == reflect.String
+}
+
+// codecRepresentable returns true if the conversion of the numeric value
+// to the target type is exact (without truncation or overflow)
+func codecRepresentable(source, target reflect.Value) bool {
+	switch {
+	case codecInt(source.Kind()):
+		value := source.Int()
+		switch {
+		case codecInt(target.Kind()):
+			return !target.OverflowInt(value)
+		case codecUint(target.Kind()):
+			return value >= 0 && !target.OverflowUint(uint64(value))
+		}
+	case codecUint(source.Kind()):
+		value := source.Uint()
+		switch {
+		case codecInt(target.Kind()):
+			return value <= math.MaxInt64 && !target.OverflowInt(int64(value))
+		case codecUint(target.Kind()):
+			return !target.OverflowUint(value)
+		}
+	case codecFloat(source.Kind()):
+		value := source.Float()
+		switch {
+		case codecInt(target.Kind()):
+			return value == math.Trunc(value) &&
+				value >= -(1<<63) && value < 1<<63 &&
+				!target.OverflowInt(int64(value))
+		case codecUint(target.Kind()):
+			return value == math.Trunc(value) &&
+				value >= 0 && value < 1<<64 &&
+				!target.OverflowUint(uint64(value))
+		case codecFloat(target.Kind()):
+			return !target.OverflowFloat(value)
+		}
+	}
+	// any other conversion is exact (e.g., binary data to a string)
+	return true
+}
+
+func codecRepresentationError(source, target reflect.Value) error {
+	return fmt.Errorf("%v is not exactly represented by %s", source.Interface(), target.Type())
+}
+
+func codecNumeric(kind reflect.Kind) bool {
+	return kind >= reflect.Int && kind <= reflect.Float64
+}
+
+func codecInt(kind reflect.Kind) bool {
+	return kind >= reflect.Int && kind <= reflect.Int64
+}
+
+func codecUint(kind reflect.Kind) bool {
+	return kind >= reflect.Uint && kind <= reflect.Uintptr
+}
+
+func codecFloat(kind reflect.Kind) bool {
+	return kind == reflect.Float32 || kind == reflect.Float64
+}
+
+// CodecError indicates service request or response data was not encoded
+// or decoded by the Codec (or the Codec name was not registered)
+type CodecError struct {
+	Codec string
+	Err   error
+}
+
+func codecErrorNew(codec string, err error) error {
+	return &CodecError{Codec: codec, Err: err}
+}
+func (e *CodecError) Error() string {
+	if e.Err == nil {
+		return "Codec \"" + e.Codec + "\" not registered"
+	}
+	return "Codec \"" + e.Codec + "\": " + e.Err.Error()
+}
+
+// Unwrap provides the error from the Codec
+func (e *CodecError) Unwrap() error {
+	return e.Err
+}
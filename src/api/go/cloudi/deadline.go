@@ -0,0 +1,113 @@
+package cloudi
+
+//-*-Mode:Go;coding:utf-8;tab-width:4;c-basic-offset:4-*-
+// ex: set ft=go fenc=utf-8 sts=4 ts=4 sw=4 noet nomod:
+//
+// MIT License
+//
+// Copyright (c) 2017-2020 Michael Truog <mjtruog at protonmail dot com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+// DEALINGS IN THE SOFTWARE.
+//
+
+import (
+	"context"
+	"time"
+)
+
+// Deadline returns the time when the service request timeout expires
+// (based on when the service request was received)
+func (request *Request) Deadline() time.Time {
+	return request.deadline
+}
+
+// Context returns a context with the service request deadline that is
+// cancelled after the service request is returned or forwarded
+func (request *Request) Context() context.Context {
+	if request.ctx == nil {
+		return context.Background()
+	}
+	return request.ctx
+}
+
+// SendAsync sends an asynchronous service request with the timeout
+// limited by the remaining service request timeout
+func (request *Request) SendAsync(name string, requestInfo, requestData []byte, options ...SendOption) ([]byte, error) {
+	return request.api.SendAsyncOptions(request.Context(), name, requestInfo, requestData, options...)
+}
+
+// SendSync sends a synchronous service request with the timeout
+// limited by the remaining service request timeout
+func (request *Request) SendSync(name string, requestInfo, requestData []byte, options ...SendOption) ([]byte, []byte, []byte, error) {
+	return request.api.SendSyncOptions(request.Context(), name, requestInfo, requestData, options...)
+}
+
+// McastAsync sends asynchronous service requests to all subscribers of
+// the matching service name pattern with the timeout limited by the
+// remaining service request timeout
+func (request *Request) McastAsync(name string, requestInfo, requestData []byte, options ...SendOption) ([][]byte, error) {
+	return request.api.McastAsyncOptions(request.Context(), name, requestInfo, requestData, options...)
+}
+
+// activeAdd stores the service request until it is returned or forwarded
+func (api *Instance) activeAdd(request *Request) {
+	if request.ctx == nil && !request.deadline.IsZero() {
+		request.ctx, request.cancel = context.WithDeadline(context.Background(), request.deadline)
+	}
+	if request.span != nil {
+		request.ctx = SpanContext(request.Context(), request.span)
+	}
+	api.activeLock.Lock()
+	api.active[request.TransId] = request
+	api.activeLock.Unlock()
+}
+
+func (api *Instance) activeGet(transId [16]byte) *Request {
+	api.activeLock.Lock()
+	request := api.active[transId]
+	api.activeLock.Unlock()
+	return request
+}
+
+func (api *Instance) activeRemove(transId [16]byte) {
+	api.activeLock.Lock()
+	request, found := api.active[transId]
+	delete(api.active, transId)
+	api.activeLock.Unlock()
+	if found && request.cancel != nil {
+		request.cancel()
+	}
+}
+
+// activeTimeout limits the timeout to the remaining service request timeout
+// and provides the service request if no time remains
+func (api *Instance) activeTimeout(transId [16]byte, timeout uint32) (uint32, *Request) {
+	request := api.activeGet(transId)
+	if request == nil || request.deadline.IsZero() {
+		return timeout, nil
+	}
+	remaining := time.Until(request.deadline) / time.Millisecond
+	if remaining <= 0 {
+		return 0, request
+	}
+	if remaining < time.Duration(timeout) {
+		return uint32(remaining), nil
+	}
+	return timeout, nil
+}
@@ -0,0 +1,180 @@
+package cloudi
+
+//-*-Mode:Go;coding:utf-8;tab-width:4;c-basic-offset:4-*-
+// ex: set ft=go fenc=utf-8 sts=4 ts=4 sw=4 noet nomod:
+//
+// MIT License
+//
+// Copyright (c) 2017-2020 Michael Truog <mjtruog at protonmail dot com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+// DEALINGS IN THE SOFTWARE.
+//
+
+import (
+	"context"
+	"reflect"
+)
+
+// Future provides the response of an asynchronous service request.
+// The response is received (with recv_async) as soon as the Future is
+// created, so it is not necessary to wait for every Future.
+type Future struct {
+	transId  TransId
+	done     chan struct{}
+	response *Response
+	err      error
+}
+
+// SendAsyncFuture sends an asynchronous service request and
+// returns a Future for the response
+func (api *Instance) SendAsyncFuture(ctx context.Context, name string, requestInfo, request []byte, options ...SendOption) (*Future, error) {
+	timeout, err := api.futureTimeout(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+	var transId []byte
+	transId, err = api.SendAsyncOptions(ctx, name, requestInfo, request, options...)
+	if err != nil {
+		return nil, err
+	}
+	return api.futureNew(transId, timeout), nil
+}
+
+// McastAsyncFutures sends asynchronous service requests to all subscribers
+// of the matching service name pattern and returns a Future for each
+func (api *Instance) McastAsyncFutures(ctx context.Context, name string, requestInfo, request []byte, options ...SendOption) ([]*Future, error) {
+	timeout, err := api.futureTimeout(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+	var transIds [][]byte
+	transIds, err = api.McastAsyncOptions(ctx, name, requestInfo, request, options...)
+	if err != nil {
+		return nil, err
+	}
+	futures := make([]*Future, 0, len(transIds))
+	for _, transId := range transIds {
+		futures = append(futures, api.futureNew(transId, timeout))
+	}
+	return futures, nil
+}
+
+// futureTimeout provides the timeout used for the service request
+// (a response is not possible after the timeout expires)
+func (api *Instance) futureTimeout(ctx context.Context, options []SendOption) (uint32, error) {
+	send, err := api.sendOptionsNew(false, options)
+	if err != nil {
+		return 0, err
+	}
+	return timeoutContext(ctx, send.timeout)
+}
+
+func (api *Instance) futureNew(transId []byte, timeout uint32) *Future {
+	future := &Future{done: make(chan struct{})}
+	copy(future.transId[:], transId)
+	if future.transId.IsZero() {
+		// the service request timed out before it was sent
+		future.response = &Response{ResponseInfo: []byte{}, Response: []byte{}}
+		close(future.done)
+		return future
+	}
+	go func() {
+		responseInfo, response, _, err := api.RecvAsyncContext(context.Background(), timeout, future.transId)
+		if err == nil {
+			future.response = &Response{ResponseInfo: responseInfo, Response: response}
+		} else {
+			future.err = err
+		}
+		close(future.done)
+	}()
+	return future
+}
+
+// TransId returns the trans id of the service request
+func (future *Future) TransId() TransId {
+	return future.transId
+}
+
+// Done returns a channel that is closed when the response is received
+// (or the service request timeout expires)
+func (future *Future) Done() <-chan struct{} {
+	return future.done
+}
+
+// Wait blocks to receive the response unless the context is done first
+// (an empty response is provided if the service request timeout expires)
+func (future *Future) Wait(ctx context.Context) (*Response, error) {
+	select {
+	case <-future.done:
+		return future.response, future.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Result blocks to receive the response
+func (future *Future) Result() (*Response, error) {
+	<-future.done
+	return future.response, future.err
+}
+
+// FutureAll blocks to receive the responses of every Future
+// (in the same order) and returns the first error that occurs
+func FutureAll(ctx context.Context, futures ...*Future) ([]*Response, error) {
+	responses := make([]*Response, len(futures))
+	for i, future := range futures {
+		response, err := future.Wait(ctx)
+		if err != nil {
+			return nil, err
+		}
+		responses[i] = response
+	}
+	return responses, nil
+}
+
+// FutureAny blocks to receive the first non-empty response and returns
+// the index of the Future that provided it. If no Future provides a
+// non-empty response, the index is -1 and the first error is returned.
+func FutureAny(ctx context.Context, futures ...*Future) (int, *Response, error) {
+	cases := make([]reflect.SelectCase, len(futures)+1)
+	for i, future := range futures {
+		cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(future.done)}
+	}
+	cases[len(futures)] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())}
+	var errFirst error
+	for remaining := len(futures); remaining > 0; remaining-- {
+		i, _, _ := reflect.Select(cases)
+		if i == len(futures) {
+			return -1, nil, ctx.Err()
+		}
+		// the case is ignored after the Future is done
+		cases[i].Chan = reflect.Value{}
+		future := futures[i]
+		if future.err != nil {
+			if errFirst == nil {
+				errFirst = future.err
+			}
+			continue
+		}
+		if len(future.response.ResponseInfo) > 0 || len(future.response.Response) > 0 {
+			return i, future.response, nil
+		}
+	}
+	return -1, nil, errFirst
+}
@@ -0,0 +1,226 @@
+package cloudi
+
+//-*-Mode:Go;coding:utf-8;tab-width:4;c-basic-offset:4-*-
+// ex: set ft=go fenc=utf-8 sts=4 ts=4 sw=4 noet nomod:
+//
+// MIT License
+//
+// Copyright (c) 2017-2020 Michael Truog <mjtruog at protonmail dot com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+// DEALINGS IN THE SOFTWARE.
+//
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HTTP headers used by the gateway
+const (
+	// GatewayHeaderRequestType is "sync" (the default) or "async"
+	GatewayHeaderRequestType = "X-Cloudi-Request-Type"
+	// GatewayHeaderTimeout is the service request timeout in milliseconds
+	GatewayHeaderTimeout = "X-Cloudi-Timeout"
+	// GatewayHeaderPriority is the service request priority
+	GatewayHeaderPriority = "X-Cloudi-Priority"
+	// GatewayHeaderTransId is the trans id of the service request
+	GatewayHeaderTransId = "X-Cloudi-Trans-Id"
+	// GatewayHeaderInfo is the prefix of each request info key
+	// (or response info key)
+	GatewayHeaderInfo = "X-Cloudi-Info-"
+)
+
+// GatewayRequestSizeMax is the maximum HTTP request body size in bytes
+// (a larger HTTP request body is a 413 status)
+const GatewayRequestSizeMax = 16 * 1024 * 1024
+
+// GatewayHandler returns an http.Handler that sends each
+// "POST /<service name>" HTTP request as a service request.
+// The HTTP request body is the service request and the HTTP response body
+// is the service response (a SendSync timeout is a 504 status).
+// An asynchronous service request is only sent, with a 202 status.
+// The handler does no authentication, so any HTTP client that can reach it
+// may send service requests with the service's identity.
+func (api *Instance) GatewayHandler() http.Handler {
+	return http.HandlerFunc(api.gateway)
+}
+
+// GatewayListen handles gateway HTTP requests on the local address
+// until the context is done.
+// Only a loopback address is accepted (e.g., "127.0.0.1:8080" or
+// "localhost:8080") because the gateway does no authentication.
+// Use GatewayHandler with an http.Server and authentication
+// to accept other HTTP clients.
+func (api *Instance) GatewayListen(ctx context.Context, address string) error {
+	if !gatewayLoopback(address) {
+		return invalidInputErrorNew("address")
+	}
+	server := &http.Server{Addr: address, Handler: api.GatewayHandler()}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = server.Close()
+		case <-done:
+		}
+	}()
+	err := server.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return ctx.Err()
+	}
+	return err
+}
+
+func (api *Instance) gateway(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	options, err := gatewayOptions(r.Header)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var requestInfo, request []byte
+	requestInfo, err = gatewayInfo(r.Header)
+	if err == nil {
+		// read one extra byte to detect a larger HTTP request body
+		request, err = io.ReadAll(io.LimitReader(r.Body, GatewayRequestSizeMax+1))
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(request) > GatewayRequestSizeMax {
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	name := r.URL.Path
+	switch strings.ToLower(r.Header.Get(GatewayHeaderRequestType)) {
+	case "", "sync":
+		var responseInfo, response, transId []byte
+		responseInfo, response, transId, err = api.SendSyncOptions(r.Context(), name, requestInfo, request, options...)
+		if err != nil {
+			gatewayError(w, err)
+			return
+		}
+		if transIdNull(transId) {
+			http.Error(w, "timeout", http.StatusGatewayTimeout)
+			return
+		}
+		header := w.Header()
+		for key, values := range InfoKeyValueParse(responseInfo) {
+			for _, value := range values {
+				header.Add(GatewayHeaderInfo+key, value)
+			}
+		}
+		header.Set(GatewayHeaderTransId, transIdFormat(transId))
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(response)
+	case "async":
+		var transId []byte
+		transId, err = api.SendAsyncOptions(r.Context(), name, requestInfo, request, options...)
+		if err != nil {
+			gatewayError(w, err)
+			return
+		}
+		if transIdNull(transId) {
+			http.Error(w, "timeout", http.StatusGatewayTimeout)
+			return
+		}
+		w.Header().Set(GatewayHeaderTransId, transIdFormat(transId))
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		http.Error(w, "invalid "+GatewayHeaderRequestType, http.StatusBadRequest)
+	}
+}
+
+func gatewayOptions(header http.Header) ([]SendOption, error) {
+	var options []SendOption
+	if value := header.Get(GatewayHeaderTimeout); value != "" {
+		timeout, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, WithTimeout(time.Duration(timeout)*time.Millisecond))
+	}
+	if value := header.Get(GatewayHeaderPriority); value != "" {
+		value, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, err
+		}
+		var priority Priority
+		priority, err = PriorityNew(value)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, WithPriority(priority))
+	}
+	return options, nil
+}
+
+// gatewayInfo provides the request info from the HTTP request headers
+func gatewayInfo(header http.Header) ([]byte, error) {
+	pairs := map[string][]string{}
+	for key, values := range header {
+		if strings.HasPrefix(key, GatewayHeaderInfo) {
+			pairs[strings.ToLower(key[len(GatewayHeaderInfo):])] = values
+		}
+	}
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	return InfoKeyValueNew(pairs)
+}
+
+// gatewayLoopback returns true if the address only listens on
+// the loopback interface
+func gatewayLoopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func gatewayError(w http.ResponseWriter, err error) {
+	var invalid *InvalidInputError
+	if errors.As(err, &invalid) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadGateway)
+}
+
+func transIdFormat(transId []byte) string {
+	value, _ := TransIdNew(transId)
+	return value.String()
+}
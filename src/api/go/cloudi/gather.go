@@ -0,0 +1,154 @@
+package cloudi
+
+//-*-Mode:Go;coding:utf-8;tab-width:4;c-basic-offset:4-*-
+// ex: set ft=go fenc=utf-8 sts=4 ts=4 sw=4 noet nomod:
+//
+// MIT License
+//
+// Copyright (c) 2017-2020 Michael Truog <mjtruog at protonmail dot com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+// DEALINGS IN THE SOFTWARE.
+//
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+// GatherStatus describes the result of a single service request
+// sent by Gather
+type GatherStatus int
+
+const (
+	// GatherPending is a service request without a result when
+	// Gather returned
+	GatherPending GatherStatus = iota
+	// GatherResponse is a service request with a non-empty response
+	GatherResponse
+	// GatherTimeout is a service request without a response
+	// (or with an empty response)
+	GatherTimeout
+	// GatherError is a service request that failed with an error
+	GatherError
+)
+
+// GatherReplica provides the diagnostics of a single service request
+// sent by Gather
+type GatherReplica struct {
+	TransId  TransId
+	Status   GatherStatus
+	Response *Response
+	Err      error
+	// Elapsed is the time from sending to receiving the result
+	Elapsed time.Duration
+}
+
+// GatherResult provides the merged result of Gather
+type GatherResult[T any] struct {
+	Value T
+	// Responses is the number of responses merged by the reducer
+	Responses int
+	Replicas  []GatherReplica
+}
+
+// Gather sends asynchronous service requests to all subscribers of the
+// matching service name pattern with McastAsync and merges the non-empty
+// responses with the reducer until the quorum is reached
+// (a quorum of 0 waits for every response). The result is returned with a
+// *QuorumError if the quorum is not reached before the service request
+// timeout expires.
+func Gather[T any](ctx context.Context, api *Instance, name string, requestInfo, request []byte, quorum int, initial T, reducer func(value T, response *Response) (T, error), options ...SendOption) (*GatherResult[T], error) {
+	if quorum < 0 {
+		return nil, invalidInputErrorNew("quorum")
+	}
+	if reducer == nil {
+		return nil, invalidInputErrorNew("reducer")
+	}
+	start := time.Now()
+	futures, err := api.McastAsyncFutures(ctx, name, requestInfo, request, options...)
+	if err != nil {
+		return nil, err
+	}
+	result := &GatherResult[T]{Value: initial, Replicas: make([]GatherReplica, len(futures))}
+	for i, future := range futures {
+		result.Replicas[i].TransId = future.TransId()
+	}
+	required := quorum
+	if required == 0 {
+		required = len(futures)
+	}
+	if len(futures) < required || len(futures) == 0 {
+		return result, quorumErrorNew(required, 0)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	completed := make(chan int, len(futures))
+	for i, future := range futures {
+		go func(i int, future *Future) {
+			select {
+			case <-future.Done():
+				completed <- i
+			case <-stop:
+			}
+		}(i, future)
+	}
+	for remaining := len(futures); remaining > 0 && result.Responses < required; remaining-- {
+		var i int
+		select {
+		case i = <-completed:
+		case <-ctx.Done():
+			return result, ctx.Err()
+		}
+		replica := &result.Replicas[i]
+		replica.Elapsed = time.Since(start)
+		replica.Response, replica.Err = futures[i].Result()
+		if replica.Err != nil {
+			replica.Status = GatherError
+			continue
+		}
+		if len(replica.Response.ResponseInfo) == 0 && len(replica.Response.Response) == 0 {
+			replica.Status = GatherTimeout
+			continue
+		}
+		replica.Status = GatherResponse
+		result.Value, err = reducer(result.Value, replica.Response)
+		if err != nil {
+			return result, err
+		}
+		result.Responses++
+	}
+	if result.Responses < required {
+		return result, quorumErrorNew(required, result.Responses)
+	}
+	return result, nil
+}
+
+// QuorumError indicates Gather did not receive enough responses
+type QuorumError struct {
+	Required  int
+	Responses int
+}
+
+func quorumErrorNew(required, responses int) error {
+	return &QuorumError{Required: required, Responses: responses}
+}
+func (e *QuorumError) Error() string {
+	return "Quorum of " + strconv.Itoa(e.Required) + " not reached (" + strconv.Itoa(e.Responses) + " responses)"
+}
@@ -0,0 +1,194 @@
+package cloudi
+
+//-*-Mode:Go;coding:utf-8;tab-width:4;c-basic-offset:4-*-
+// ex: set ft=go fenc=utf-8 sts=4 ts=4 sw=4 noet nomod:
+//
+// MIT License
+//
+// Copyright (c) 2017-2020 Michael Truog <mjtruog at protonmail dot com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+// DEALINGS IN THE SOFTWARE.
+//
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// hedgeLatencies is the number of recent latencies used for a percentile
+const hedgeLatencies = 128
+
+// hedgeLatenciesMin is the number of latencies required for a percentile
+const hedgeLatenciesMin = 10
+
+// Hedge decides when SendSyncHedged sends a duplicate service request.
+// A Hedge records the latency of responses, so it should be shared by
+// the service requests sent to the same destination.
+type Hedge struct {
+	// Delay is the time without a response before a duplicate
+	// service request is sent
+	Delay time.Duration
+	// Percentile is a fraction (e.g., 0.95) of the recent response latencies
+	// used instead of the Delay, once enough latencies are recorded
+	Percentile float64
+	// Duplicates is the maximum number of duplicate service requests
+	// (0 is 1)
+	Duplicates int
+	latencies  []time.Duration
+	next       int
+	lock       sync.Mutex
+}
+
+// delay provides the time before sending a duplicate service request
+func (hedge *Hedge) delay() time.Duration {
+	hedge.lock.Lock()
+	defer hedge.lock.Unlock()
+	if hedge.Percentile == 0 || len(hedge.latencies) < hedgeLatenciesMin {
+		return hedge.Delay
+	}
+	latencies := make([]time.Duration, len(hedge.latencies))
+	copy(latencies, hedge.latencies)
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+	return latencies[int(hedge.Percentile*float64(len(latencies)-1))]
+}
+
+func (hedge *Hedge) record(latency time.Duration) {
+	hedge.lock.Lock()
+	if len(hedge.latencies) < hedgeLatencies {
+		hedge.latencies = append(hedge.latencies, latency)
+	} else {
+		hedge.latencies[hedge.next] = latency
+		hedge.next = (hedge.next + 1) % hedgeLatencies
+	}
+	hedge.lock.Unlock()
+}
+
+// SendSyncHedged sends a service request and then sends duplicates
+// (based on the Hedge) while a response has not been received,
+// to return the first response. The service requests are sent with
+// SendAsync (so they should only be used with read-only services) and
+// every service request shares the timeout. A duplicate is sent
+// immediately if every service request sent completed without a response.
+// The responses that arrive later are received and discarded.
+func (api *Instance) SendSyncHedged(ctx context.Context, name string, requestInfo, request []byte, hedge *Hedge, options ...SendOption) ([]byte, []byte, []byte, error) {
+	if hedge == nil || hedge.Delay < 0 || hedge.Percentile < 0 ||
+		hedge.Percentile > 1 || hedge.Duplicates < 0 {
+		return nil, nil, nil, invalidInputErrorNew("hedge")
+	}
+	send, err := api.sendOptionsNew(true, options)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	duplicates := hedge.Duplicates
+	if duplicates == 0 {
+		duplicates = 1
+	}
+	deadline := time.Now().Add(time.Duration(send.timeout) * time.Millisecond)
+	completed := make(chan *Future, duplicates+1)
+	pending := 0
+	sendFuture := func() error {
+		timeout := time.Until(deadline)
+		if timeout < time.Millisecond {
+			return nil
+		}
+		sent := time.Now()
+		future, err := api.SendAsyncFuture(ctx, name, requestInfo, request, append(options[:len(options):len(options)], WithTimeout(timeout))...)
+		if err != nil {
+			if errors.Is(err, ErrTimeout) {
+				// the service request timed out before it was sent
+				return nil
+			}
+			return err
+		}
+		pending++
+		go func() {
+			// the latency of every service request is recorded
+			// (including the responses that arrive later and timeouts)
+			<-future.Done()
+			hedge.record(time.Since(sent))
+			completed <- future
+		}()
+		return nil
+	}
+	timer := time.NewTimer(hedge.delay())
+	defer timer.Stop()
+	err = sendFuture()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var errFirst error
+	for {
+		if pending == 0 {
+			// every service request completed without a response,
+			// so a duplicate is sent without waiting for the delay
+			if duplicates == 0 {
+				break
+			}
+			duplicates--
+			err = sendFuture()
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			if pending == 0 && time.Until(deadline) < time.Millisecond {
+				break
+			}
+			continue
+		}
+		select {
+		case future := <-completed:
+			pending--
+			response, err := future.Result()
+			if err != nil {
+				if errFirst == nil {
+					errFirst = err
+				}
+				continue
+			}
+			if len(response.ResponseInfo) == 0 && len(response.Response) == 0 {
+				continue
+			}
+			transId := future.TransId()
+			return response.ResponseInfo, response.Response, transId[:], nil
+		case <-timer.C:
+			if duplicates > 0 {
+				duplicates--
+				err = sendFuture()
+				if err != nil {
+					return nil, nil, nil, err
+				}
+				timer.Reset(hedge.delay())
+			}
+		case <-ctx.Done():
+			return nil, nil, nil, ctx.Err()
+		}
+	}
+	if errFirst != nil {
+		return nil, nil, nil, errFirst
+	}
+	// every service request timed out
+	if send.timeoutError {
+		return nil, nil, nil, timeoutErrorNew(name, send.timeout)
+	}
+	return []byte{}, []byte{}, make([]byte, 16), nil
+}
@@ -0,0 +1,189 @@
+package cloudi
+
+//-*-Mode:Go;coding:utf-8;tab-width:4;c-basic-offset:4-*-
+// ex: set ft=go fenc=utf-8 sts=4 ts=4 sw=4 noet nomod:
+//
+// MIT License
+//
+// Copyright (c) 2017-2020 Michael Truog <mjtruog at protonmail dot com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+// DEALINGS IN THE SOFTWARE.
+//
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// request info keys added by cloudi_service_http_cowboy that are not
+// HTTP request headers
+var httpRequestInfoKeys = map[string]bool{
+	"peer":           true,
+	"peer-port":      true,
+	"source-address": true,
+	"source-port":    true,
+	"service-name":   true,
+	"url-path":       true,
+}
+
+type httpRequestKey struct {
+}
+
+// HTTPRequest returns the service request that provided the
+// *http.Request to an http.Handler used with HTTPHandler
+func HTTPRequest(r *http.Request) *Request {
+	request, _ := r.Context().Value(httpRequestKey{}).(*Request)
+	return request
+}
+
+// HTTPHandler provides a Callback that handles a service request sent by
+// cloudi_service_http_cowboy with an http.Handler. The HTTP method is the
+// suffix of the service name pattern (e.g., "/get") and the request info
+// provides the HTTP request headers. The http.ResponseWriter status and
+// headers are provided as response info.
+func HTTPHandler(h http.Handler) Callback {
+	return func(requestType int, name, pattern string, requestInfo, requestData []byte, timeout uint32, priority int8, transId [16]byte, pid Source, state interface{}, api *Instance) ([]byte, []byte, error) {
+		request := api.activeGet(transId)
+		if request == nil {
+			request = &Request{RequestType: requestType, Name: name, Pattern: pattern, RequestInfo: requestInfo, Request: requestData, Timeout: timeout, Priority: priority, TransId: transId, Source: pid, state: state, api: api, deadline: time.Now().Add(time.Duration(timeout) * time.Millisecond)}
+		}
+		ctx, cancel := context.WithDeadline(request.Context(), request.Deadline())
+		defer cancel()
+		r, err := httpRequestNew(context.WithValue(ctx, httpRequestKey{}, request), request)
+		if err != nil {
+			return nil, nil, err
+		}
+		w := &httpResponseWriter{header: http.Header{}}
+		h.ServeHTTP(w, r)
+		return w.result()
+	}
+}
+
+func httpRequestNew(ctx context.Context, request *Request) (*http.Request, error) {
+	method, path := httpMethod(request.Pattern, request.Name)
+	info := InfoKeyValueParse(request.RequestInfo)
+	if urlPath := info["url-path"]; len(urlPath) > 0 {
+		path = urlPath[0]
+	}
+	var query string
+	var body []byte
+	if method == http.MethodGet {
+		query = httpQuery(request.Request)
+	} else {
+		body = request.Request
+	}
+	target, err := url.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+	target.RawQuery = query
+	var r *http.Request
+	r, err = http.NewRequestWithContext(ctx, method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range info {
+		if httpRequestInfoKeys[key] {
+			continue
+		}
+		for _, value := range values {
+			r.Header.Add(key, value)
+		}
+	}
+	r.Host = r.Header.Get("Host")
+	r.Header.Del("Host")
+	r.RequestURI = target.RequestURI()
+	address := info["source-address"]
+	port := info["source-port"]
+	if len(address) > 0 && len(port) > 0 {
+		r.RemoteAddr = net.JoinHostPort(address[0], port[0])
+	}
+	return r, nil
+}
+
+// httpMethod returns the HTTP method from the service name pattern suffix
+// and the service name without the suffix
+func httpMethod(pattern, name string) (string, string) {
+	i := strings.LastIndexByte(pattern, '/')
+	if i < 0 {
+		return http.MethodGet, name
+	}
+	suffix := pattern[i:]
+	return strings.ToUpper(suffix[1:]), strings.TrimSuffix(name, suffix)
+}
+
+// httpQuery returns the query string of a GET request provided as
+// key/value data (or as the raw query string)
+func httpQuery(request []byte) string {
+	if len(request) == 0 || request[len(request)-1] != 0 {
+		return string(request)
+	}
+	values := url.Values(InfoKeyValueParse(request))
+	return values.Encode()
+}
+
+type httpResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *httpResponseWriter) Header() http.Header {
+	return w.header
+}
+func (w *httpResponseWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.body.Write(data)
+}
+func (w *httpResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+// result provides the response info and response, with the
+// Content-Type detected (like net/http) if it was not set
+func (w *httpResponseWriter) result() ([]byte, []byte, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	response := w.body.Bytes()
+	pairs := map[string][]string{
+		"status": {strconv.Itoa(w.status)},
+	}
+	for key, values := range w.header {
+		pairs[strings.ToLower(key)] = values
+	}
+	if _, found := w.header["Content-Type"]; !found && len(response) > 0 {
+		pairs["content-type"] = []string{http.DetectContentType(response)}
+	}
+	responseInfo, err := InfoKeyValueNew(pairs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return responseInfo, response, nil
+}
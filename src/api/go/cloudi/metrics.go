@@ -0,0 +1,425 @@
+package cloudi
+
+//-*-Mode:Go;coding:utf-8;tab-width:4;c-basic-offset:4-*-
+// ex: set ft=go fenc=utf-8 sts=4 ts=4 sw=4 noet nomod:
+//
+// MIT License
+//
+// Copyright (c) 2017-2020 Michael Truog <mjtruog at protonmail dot com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+// DEALINGS IN THE SOFTWARE.
+//
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetricsBuckets are the default latency histogram buckets
+var MetricsBuckets = []time.Duration{
+	time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// MetricsDestinationsMax is the default maximum count of service names
+// used as separate destinations, since service names are not bounded
+// (any other service names are recorded as MetricsDestinationOther)
+var MetricsDestinationsMax = 256
+
+// MetricsDestinationOther is the destination used for service names
+// after MetricsDestinationsMax destinations exist
+const MetricsDestinationOther = "other"
+
+// Metrics records service request metrics for any number of Instances
+// (e.g., all the threads of a service), after MetricsSet is called
+type Metrics struct {
+	buckets         []time.Duration
+	patterns        map[string]*metricsPattern
+	destinations    map[string]*metricsDestination
+	destinationsMax int
+	recvTimeouts    uint64
+	lock            sync.Mutex
+}
+
+type metricsPattern struct {
+	async   uint64
+	sync    uint64
+	errors  uint64
+	panics  uint64
+	latency metricsHistogram
+}
+
+type metricsDestination struct {
+	requests uint64
+	errors   uint64
+	timeouts uint64
+	latency  metricsHistogram
+}
+
+type metricsHistogram struct {
+	counts []uint64
+	count  uint64
+	sum    time.Duration
+}
+
+// MetricsNew creates Metrics with the latency histogram buckets provided
+// (in increasing order) or MetricsBuckets
+func MetricsNew(buckets ...time.Duration) (*Metrics, error) {
+	if len(buckets) == 0 {
+		buckets = MetricsBuckets
+	}
+	for i, bucket := range buckets {
+		if bucket <= 0 || (i > 0 && bucket <= buckets[i-1]) {
+			return nil, invalidInputErrorNew("buckets")
+		}
+	}
+	return &Metrics{
+		buckets:         append([]time.Duration(nil), buckets...),
+		patterns:        map[string]*metricsPattern{},
+		destinations:    map[string]*metricsDestination{},
+		destinationsMax: MetricsDestinationsMax,
+	}, nil
+}
+
+// DestinationsMaxSet sets the maximum count of service names used as
+// separate destinations (new service names after the maximum are
+// recorded as MetricsDestinationOther)
+func (metrics *Metrics) DestinationsMaxSet(count int) error {
+	if count < 0 {
+		return invalidInputErrorNew("count")
+	}
+	metrics.lock.Lock()
+	metrics.destinationsMax = count
+	metrics.lock.Unlock()
+	return nil
+}
+
+// MetricsSet records the metrics of the Instance with the Metrics provided
+// (nil stops recording)
+func (api *Instance) MetricsSet(metrics *Metrics) {
+	api.lock.Lock()
+	api.metrics = metrics
+	api.lock.Unlock()
+}
+
+// Stats returns a snapshot of the Metrics recording the Instance
+// (nil if MetricsSet was not called)
+func (api *Instance) Stats() *MetricsStats {
+	return api.metricsGet().Stats()
+}
+
+func (api *Instance) metricsGet() *Metrics {
+	api.lock.RLock()
+	defer api.lock.RUnlock()
+	return api.metrics
+}
+
+// MetricsStats is a snapshot of Metrics
+type MetricsStats struct {
+	// Patterns are keyed by the service name pattern of the
+	// service requests received
+	Patterns map[string]*MetricsPattern
+	// Destinations are keyed by the service name of the
+	// service requests sent (or MetricsDestinationOther)
+	Destinations map[string]*MetricsDestination
+	// RecvTimeouts is the count of asynchronous service request
+	// responses that timed out when received with RecvAsync or RecvAsyncs
+	// (the service name is not known)
+	RecvTimeouts uint64
+}
+
+// MetricsPattern provides the metrics of a service name pattern
+type MetricsPattern struct {
+	// Async is the count of asynchronous service requests received
+	Async uint64
+	// Sync is the count of synchronous service requests received
+	Sync uint64
+	// Errors is the count of errors returned by the Handler
+	Errors uint64
+	// Panics is the count of panics in the Handler
+	// (not including a Return or Forward)
+	Panics uint64
+	// Latency is the time spent in the Handler
+	Latency MetricsHistogram
+}
+
+// MetricsDestination provides the metrics of a service name
+// used by SendAsync, SendSync or McastAsync
+type MetricsDestination struct {
+	// Requests is the count of service requests sent
+	Requests uint64
+	// Errors is the count of service requests that failed with an error
+	Errors uint64
+	// Timeouts is the count of service requests that timed out
+	// (or had no destination with McastAsync)
+	Timeouts uint64
+	// Latency is the SendSync response time (not including timeouts)
+	Latency MetricsHistogram
+}
+
+// MetricsHistogram is a latency histogram
+type MetricsHistogram struct {
+	// Buckets are the upper bound of each bucket
+	Buckets []time.Duration
+	// Counts are the cumulative count of each bucket
+	Counts []uint64
+	// Count is the count of all values
+	Count uint64
+	// Sum is the sum of all values
+	Sum time.Duration
+}
+
+// Stats returns a snapshot of the Metrics
+func (metrics *Metrics) Stats() *MetricsStats {
+	if metrics == nil {
+		return nil
+	}
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	stats := &MetricsStats{
+		Patterns:     make(map[string]*MetricsPattern, len(metrics.patterns)),
+		Destinations: make(map[string]*MetricsDestination, len(metrics.destinations)),
+		RecvTimeouts: metrics.recvTimeouts,
+	}
+	for pattern, value := range metrics.patterns {
+		stats.Patterns[pattern] = &MetricsPattern{
+			Async:   value.async,
+			Sync:    value.sync,
+			Errors:  value.errors,
+			Panics:  value.panics,
+			Latency: metrics.histogram(&value.latency),
+		}
+	}
+	for name, value := range metrics.destinations {
+		stats.Destinations[name] = &MetricsDestination{
+			Requests: value.requests,
+			Errors:   value.errors,
+			Timeouts: value.timeouts,
+			Latency:  metrics.histogram(&value.latency),
+		}
+	}
+	return stats
+}
+
+func (metrics *Metrics) histogram(histogram *metricsHistogram) MetricsHistogram {
+	result := MetricsHistogram{
+		Buckets: append([]time.Duration(nil), metrics.buckets...),
+		Counts:  make([]uint64, len(metrics.buckets)),
+		Count:   histogram.count,
+		Sum:     histogram.sum,
+	}
+	var count uint64
+	for i := range metrics.buckets {
+		if histogram.counts != nil {
+			count += histogram.counts[i]
+		}
+		result.Counts[i] = count
+	}
+	return result
+}
+
+func (metrics *Metrics) observe(histogram *metricsHistogram, elapsed time.Duration) {
+	if histogram.counts == nil {
+		histogram.counts = make([]uint64, len(metrics.buckets))
+	}
+	i := sort.Search(len(metrics.buckets), func(i int) bool {
+		return elapsed <= metrics.buckets[i]
+	})
+	if i < len(metrics.buckets) {
+		histogram.counts[i]++
+	}
+	histogram.count++
+	histogram.sum += elapsed
+}
+
+// request records a service request handled by a Handler
+func (metrics *Metrics) request(request *Request, elapsed time.Duration, err error, panicked bool) {
+	if metrics == nil {
+		return
+	}
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	value := metrics.patterns[request.Pattern]
+	if value == nil {
+		value = &metricsPattern{}
+		metrics.patterns[request.Pattern] = value
+	}
+	if request.RequestType == ASYNC {
+		value.async++
+	} else {
+		value.sync++
+	}
+	if panicked {
+		value.panics++
+	} else if handlerError(err) {
+		value.errors++
+	}
+	metrics.observe(&value.latency, elapsed)
+}
+
+// send records a service request sent to a destination
+func (metrics *Metrics) send(name string, sync bool, elapsed time.Duration, err error, timeout bool) {
+	if metrics == nil {
+		return
+	}
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	value := metrics.destinations[name]
+	if value == nil && len(metrics.destinations) >= metrics.destinationsMax {
+		name = MetricsDestinationOther
+		value = metrics.destinations[name]
+	}
+	if value == nil {
+		value = &metricsDestination{}
+		metrics.destinations[name] = value
+	}
+	value.requests++
+	if err != nil {
+		value.errors++
+	} else if timeout {
+		value.timeouts++
+	}
+	if sync && err == nil && !timeout {
+		metrics.observe(&value.latency, elapsed)
+	}
+}
+
+// recvTimeout records an asynchronous service request response timeout
+func (metrics *Metrics) recvTimeout() {
+	if metrics == nil {
+		return
+	}
+	metrics.lock.Lock()
+	metrics.recvTimeouts++
+	metrics.lock.Unlock()
+}
+
+// ServeHTTP provides the Metrics in the Prometheus text format
+func (metrics *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = metrics.WritePrometheus(w)
+}
+
+// WritePrometheus writes the Metrics in the Prometheus text format
+func (metrics *Metrics) WritePrometheus(w io.Writer) error {
+	stats := metrics.Stats()
+	if stats == nil {
+		return invalidInputErrorNew("metrics")
+	}
+	output := bufio.NewWriter(w)
+	patterns := make([]string, 0, len(stats.Patterns))
+	for pattern := range stats.Patterns {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	names := make([]string, 0, len(stats.Destinations))
+	for name := range stats.Destinations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	prometheusHeader(output, "cloudi_requests_total", "counter",
+		"Service requests received by service name pattern.")
+	for _, pattern := range patterns {
+		label := prometheusLabel("pattern", pattern)
+		prometheusValue(output, "cloudi_requests_total", label+`,type="async"`, stats.Patterns[pattern].Async)
+		prometheusValue(output, "cloudi_requests_total", label+`,type="sync"`, stats.Patterns[pattern].Sync)
+	}
+	prometheusHeader(output, "cloudi_request_errors_total", "counter",
+		"Errors returned by the service request handler.")
+	for _, pattern := range patterns {
+		prometheusValue(output, "cloudi_request_errors_total", prometheusLabel("pattern", pattern), stats.Patterns[pattern].Errors)
+	}
+	prometheusHeader(output, "cloudi_request_panics_total", "counter",
+		"Panics in the service request handler.")
+	for _, pattern := range patterns {
+		prometheusValue(output, "cloudi_request_panics_total", prometheusLabel("pattern", pattern), stats.Patterns[pattern].Panics)
+	}
+	prometheusHeader(output, "cloudi_request_duration_seconds", "histogram",
+		"Time spent in the service request handler.")
+	for _, pattern := range patterns {
+		prometheusHistogram(output, "cloudi_request_duration_seconds", prometheusLabel("pattern", pattern), &stats.Patterns[pattern].Latency)
+	}
+	prometheusHeader(output, "cloudi_send_total", "counter",
+		"Service requests sent by service name.")
+	for _, name := range names {
+		prometheusValue(output, "cloudi_send_total", prometheusLabel("name", name), stats.Destinations[name].Requests)
+	}
+	prometheusHeader(output, "cloudi_send_errors_total", "counter",
+		"Service requests sent that failed with an error.")
+	for _, name := range names {
+		prometheusValue(output, "cloudi_send_errors_total", prometheusLabel("name", name), stats.Destinations[name].Errors)
+	}
+	prometheusHeader(output, "cloudi_send_timeouts_total", "counter",
+		"Service requests sent that timed out.")
+	for _, name := range names {
+		prometheusValue(output, "cloudi_send_timeouts_total", prometheusLabel("name", name), stats.Destinations[name].Timeouts)
+	}
+	prometheusHeader(output, "cloudi_recv_async_timeouts_total", "counter",
+		"Asynchronous service request responses that timed out.")
+	_, _ = output.WriteString("cloudi_recv_async_timeouts_total " + strconv.FormatUint(stats.RecvTimeouts, 10) + "\n")
+	prometheusHeader(output, "cloudi_send_duration_seconds", "histogram",
+		"Synchronous service request response time.")
+	for _, name := range names {
+		prometheusHistogram(output, "cloudi_send_duration_seconds", prometheusLabel("name", name), &stats.Destinations[name].Latency)
+	}
+	return output.Flush()
+}
+
+var prometheusEscape = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func prometheusLabel(key, value string) string {
+	return key + `="` + prometheusEscape.Replace(value) + `"`
+}
+
+func prometheusHeader(output *bufio.Writer, metric, metricType, help string) {
+	_, _ = output.WriteString("# HELP " + metric + " " + help + "\n")
+	_, _ = output.WriteString("# TYPE " + metric + " " + metricType + "\n")
+}
+
+func prometheusValue(output *bufio.Writer, metric, labels string, value uint64) {
+	_, _ = output.WriteString(metric + "{" + labels + "} " + strconv.FormatUint(value, 10) + "\n")
+}
+
+func prometheusHistogram(output *bufio.Writer, metric, labels string, histogram *MetricsHistogram) {
+	for i, bucket := range histogram.Buckets {
+		le := strconv.FormatFloat(bucket.Seconds(), 'g', -1, 64)
+		prometheusValue(output, metric+"_bucket", labels+`,le="`+le+`"`, histogram.Counts[i])
+	}
+	prometheusValue(output, metric+"_bucket", labels+`,le="+Inf"`, histogram.Count)
+	_, _ = output.WriteString(metric + "_sum{" + labels + "} " + strconv.FormatFloat(histogram.Sum.Seconds(), 'g', -1, 64) + "\n")
+	prometheusValue(output, metric+"_count", labels, histogram.Count)
+}
@@ -0,0 +1,171 @@
+package cloudi
+
+//-*-Mode:Go;coding:utf-8;tab-width:4;c-basic-offset:4-*-
+// ex: set ft=go fenc=utf-8 sts=4 ts=4 sw=4 noet nomod:
+//
+// MIT License
+//
+// Copyright (c) 2017-2020 Michael Truog <mjtruog at protonmail dot com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+// DEALINGS IN THE SOFTWARE.
+//
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// Priority is a service request priority (a lower value is a higher priority)
+type Priority int8
+
+const (
+	// PriorityHigh is the highest service request priority
+	PriorityHigh Priority = math.MinInt8
+	// PriorityLow is the lowest service request priority
+	PriorityLow Priority = math.MaxInt8
+)
+
+// PriorityNew returns a Priority after checking the range of the value
+func PriorityNew(value int) (Priority, error) {
+	if value < math.MinInt8 || value > math.MaxInt8 {
+		return 0, invalidInputErrorNew("value")
+	}
+	return Priority(value), nil
+}
+
+type sendOptions struct {
+	timeout  uint32
+	priority int8
+	retry    *RetryPolicy
+	breaker  *Breaker
+	// timeoutError is set by WithTimeoutError
+	timeoutError bool
+	// recv is set for RecvAsync (only the timeout options are accepted)
+	recv bool
+}
+
+// SendOption is an optional service request parameter
+type SendOption func(options *sendOptions) error
+
+// WithTimeout sets the service request timeout (with millisecond precision)
+func WithTimeout(timeout time.Duration) SendOption {
+	return func(options *sendOptions) error {
+		milliseconds, err := timeoutDuration(timeout)
+		if err != nil {
+			return err
+		}
+		options.timeout = milliseconds
+		return nil
+	}
+}
+
+// WithPriority sets the service request priority
+func WithPriority(priority Priority) SendOption {
+	return func(options *sendOptions) error {
+		if options.recv {
+			return invalidInputErrorNew("priority")
+		}
+		options.priority = int8(priority)
+		return nil
+	}
+}
+
+// WithTimeoutError returns a TimeoutError (matching ErrTimeout) when the
+// service request times out, instead of an empty response with a nil error.
+// McastAsync returns a NoDestinationError (matching ErrNoDestination)
+// when no destinations were found. RecvAsync also accepts this option.
+func WithTimeoutError() SendOption {
+	return func(options *sendOptions) error {
+		options.timeoutError = true
+		return nil
+	}
+}
+
+// sendAttempt sends a service request once
+// (the response is nil after a SendAsync service request is sent)
+type sendAttempt func(requestInfo []byte, options *sendOptions) (*Response, []byte, error)
+
+// attempts sends a service request with the Breaker and RetryPolicy
+func (options *sendOptions) attempts(ctx context.Context, name string, requestInfo []byte, attempt sendAttempt) (*Response, []byte, error) {
+	if options.breaker != nil {
+		attempt = options.breaker.attempt(name, attempt)
+	}
+	if options.retry != nil {
+		return options.retry.send(ctx, options, requestInfo, attempt)
+	}
+	return attempt(requestInfo, options)
+}
+
+func (api *Instance) sendOptionsNew(sync bool, options []SendOption) (*sendOptions, error) {
+	result := &sendOptions{}
+	api.lock.RLock()
+	if sync {
+		result.timeout = api.timeoutSync
+	} else {
+		result.timeout = api.timeoutAsync
+	}
+	result.priority = api.priorityDefault
+	api.lock.RUnlock()
+	for _, option := range options {
+		if option == nil {
+			return nil, invalidInputErrorNew("options")
+		}
+		err := option(result)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// sendOptionsVariadic provides the SendOption values for the
+// timeoutPriority ...interface{} parameter of the older functions
+func sendOptionsVariadic(timeoutPriority []interface{}) ([]SendOption, error) {
+	extraArity := len(timeoutPriority)
+	if extraArity > 2 {
+		return nil, invalidInputErrorNew("timeoutPriority")
+	}
+	options := make([]SendOption, 0, extraArity)
+	if extraArity > 0 {
+		timeout, err := timeoutCheck(timeoutPriority[0])
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, func(options *sendOptions) error {
+			options.timeout = timeout
+			return nil
+		})
+	}
+	if extraArity > 1 {
+		priority, err := priorityCheck(timeoutPriority[1])
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, WithPriority(Priority(priority)))
+	}
+	return options, nil
+}
+
+func timeoutDuration(timeout time.Duration) (uint32, error) {
+	if timeout < 0 || timeout/time.Millisecond > math.MaxUint32 {
+		return 0, invalidInputErrorNew("timeout")
+	}
+	return uint32(timeout / time.Millisecond), nil
+}
@@ -0,0 +1,182 @@
+package cloudi
+
+//-*-Mode:Go;coding:utf-8;tab-width:4;c-basic-offset:4-*-
+// ex: set ft=go fenc=utf-8 sts=4 ts=4 sw=4 noet nomod:
+//
+// MIT License
+//
+// Copyright (c) 2017-2020 Michael Truog <mjtruog at protonmail dot com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+// DEALINGS IN THE SOFTWARE.
+//
+
+import (
+	"errors"
+)
+
+// Service name patterns use the same semantics as the CloudI core.
+// The "*" and "?" wildcard characters match a non-empty string
+// (like the ".+" regex). The "?" wildcard character matches the shortest
+// string before the next character in the pattern, while the "*" wildcard
+// character matches any string before the next character in the pattern.
+// "**", "??", "*?" and "?*" are forbidden and "?" must not be the last
+// character in the pattern. A service name must not contain wildcard
+// characters.
+
+const (
+	patternWildcardAny    = '*'
+	patternWildcardSingle = '?'
+)
+
+func patternWildcard(c rune) bool {
+	return c == patternWildcardAny || c == patternWildcardSingle
+}
+
+// PatternCheck returns true if the service name pattern contains
+// wildcard characters (an error is returned for an invalid pattern)
+func PatternCheck(pattern string) (bool, error) {
+	result := false
+	previous := false
+	characters := []rune(pattern)
+	for i, c := range characters {
+		if !patternWildcard(c) {
+			previous = false
+			continue
+		}
+		if previous || (c == patternWildcardSingle && i == len(characters)-1) {
+			return false, invalidInputErrorNew("pattern")
+		}
+		previous = true
+		result = true
+	}
+	return result, nil
+}
+
+// PatternMatch returns true if the service name matches the
+// service name pattern
+func PatternMatch(pattern, name string) (bool, error) {
+	_, err := PatternParse(pattern, name)
+	if err != nil {
+		var mismatch *PatternMismatchError
+		if errors.As(err, &mismatch) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// PatternParse returns the strings matched by the wildcard characters
+// of the service name pattern
+func PatternParse(pattern, name string) ([]string, error) {
+	_, err := PatternCheck(pattern)
+	if err != nil {
+		return nil, err
+	}
+	nameCharacters := []rune(name)
+	for _, c := range nameCharacters {
+		if patternWildcard(c) {
+			return nil, invalidInputErrorNew("name")
+		}
+	}
+	parameters, match := patternParse([]rune(pattern), nameCharacters, []string{})
+	if !match {
+		return nil, patternMismatchErrorNew(pattern, name)
+	}
+	return parameters, nil
+}
+
+func patternParse(pattern, name []rune, parameters []string) ([]string, bool) {
+	for len(pattern) > 0 {
+		c := pattern[0]
+		if !patternWildcard(c) {
+			if len(name) == 0 || name[0] != c {
+				return nil, false
+			}
+			pattern = pattern[1:]
+			name = name[1:]
+			continue
+		}
+		if len(name) == 0 {
+			return nil, false
+		}
+		if len(pattern) == 1 {
+			return append(parameters, string(name)), true
+		}
+		next := pattern[1]
+		if c == patternWildcardSingle && name[0] == next {
+			return nil, false
+		}
+		// the first character always belongs to the parameter
+		for i := 1; i < len(name); i++ {
+			if name[i] != next {
+				continue
+			}
+			// each attempt gets a separate parameters slice
+			result, match := patternParse(pattern[2:], name[i+1:], append(parameters[:len(parameters):len(parameters)], string(name[:i])))
+			if match || c == patternWildcardSingle {
+				return result, match
+			}
+		}
+		return nil, false
+	}
+	return parameters, len(name) == 0
+}
+
+// PatternFill returns the service name created by replacing each
+// wildcard character in the service name pattern with a parameter
+// (consecutive wildcard characters may be used)
+func PatternFill(pattern string, parameters []string) (string, error) {
+	var name []rune
+	for _, c := range pattern {
+		if !patternWildcard(c) {
+			name = append(name, c)
+			continue
+		}
+		if len(parameters) == 0 {
+			return "", invalidInputErrorNew("parameters")
+		}
+		name = append(name, []rune(parameters[0])...)
+		parameters = parameters[1:]
+	}
+	if len(parameters) > 0 {
+		return "", invalidInputErrorNew("parameters")
+	}
+	return string(name), nil
+}
+
+// Parameters returns the strings matched by the wildcard characters of
+// the service name pattern (e.g., with the Name and Pattern of a Request)
+func (api *Instance) Parameters(pattern, name string) ([]string, error) {
+	return PatternParse(pattern, name)
+}
+
+// PatternMismatchError indicates the service name does not match the
+// service name pattern
+type PatternMismatchError struct {
+	Pattern string
+	Name    string
+}
+
+func patternMismatchErrorNew(pattern, name string) error {
+	return &PatternMismatchError{Pattern: pattern, Name: name}
+}
+func (e *PatternMismatchError) Error() string {
+	return "Service name \"" + e.Name + "\" does not match \"" + e.Pattern + "\""
+}
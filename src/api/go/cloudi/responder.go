@@ -0,0 +1,146 @@
+package cloudi
+
+//-*-Mode:Go;coding:utf-8;tab-width:4;c-basic-offset:4-*-
+// ex: set ft=go fenc=utf-8 sts=4 ts=4 sw=4 noet nomod:
+//
+// MIT License
+//
+// Copyright (c) 2017-2020 Michael Truog <mjtruog at protonmail dot com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+// DEALINGS IN THE SOFTWARE.
+//
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Responder provides the response to a service request from any goroutine
+// after the Handler has returned. The CloudI core provides the next service
+// request to the thread only after the response is provided, so a Responder
+// frees the Poll goroutine without increasing the number of service requests
+// handled concurrently.
+type Responder struct {
+	api         *Instance
+	requestType int
+	name        string
+	pattern     string
+	timeout     uint32
+	priority    int8
+	transId     [16]byte
+	source      Source
+	deadline    time.Time
+	done        bool
+	expire      *time.Timer
+	lock        sync.Mutex
+}
+
+// Defer returns a Responder for the service request, to be provided
+// by the Handler returning the Responder Deferred result
+func (request *Request) Defer() *Responder {
+	if request.responder == nil {
+		request.responder = &Responder{api: request.api, requestType: request.RequestType, name: request.Name, pattern: request.Pattern, timeout: request.Timeout, priority: request.Priority, transId: request.TransId, source: request.Source, deadline: request.deadline}
+	}
+	return request.responder
+}
+
+// Deferred is the result a Handler returns after calling Defer
+// (a null response is returned if the service request timeout expires).
+// If the Handler returns a different result after calling Defer,
+// the Responder is not used.
+func (responder *Responder) Deferred() (*Response, error) {
+	responder.lock.Lock()
+	defer responder.lock.Unlock()
+	if !responder.done && responder.expire == nil {
+		remaining := time.Duration(responder.timeout) * time.Millisecond
+		if !responder.deadline.IsZero() {
+			remaining = time.Until(responder.deadline)
+		}
+		responder.expire = time.AfterFunc(remaining, func() {
+			_ = responder.Return(nil, nil)
+		})
+	}
+	return nil, deferredErrorNew()
+}
+
+// Return provides the response to the service request
+func (responder *Responder) Return(responseInfo, response []byte) error {
+	err := responder.respond()
+	if err != nil {
+		return err
+	}
+	switch responder.requestType {
+	case ASYNC:
+		return responder.api.returnAsyncI(responder.name, responder.pattern, responseInfo, response, responder.timeout, responder.transId, responder.source)
+	case SYNC:
+		return responder.api.returnSyncI(responder.name, responder.pattern, responseInfo, response, responder.timeout, responder.transId, responder.source)
+	default:
+		return invalidInputErrorNew("requestType")
+	}
+}
+
+// Forward forwards the service request to a different service name
+func (responder *Responder) Forward(name string, requestInfo, request []byte, timeout uint32, priority int8) error {
+	err := responder.respond()
+	if err != nil {
+		return err
+	}
+	switch responder.requestType {
+	case ASYNC:
+		return responder.api.forwardAsyncI(name, requestInfo, request, timeout, priority, responder.transId, responder.source)
+	case SYNC:
+		return responder.api.forwardSyncI(name, requestInfo, request, timeout, priority, responder.transId, responder.source)
+	default:
+		return invalidInputErrorNew("requestType")
+	}
+}
+
+// respond allows only a single response
+func (responder *Responder) respond() error {
+	responder.lock.Lock()
+	defer responder.lock.Unlock()
+	if responder.done {
+		return invalidInputErrorNew("responder")
+	}
+	responder.done = true
+	if responder.expire != nil {
+		_ = responder.expire.Stop()
+	}
+	return nil
+}
+
+// ErrDeferred matches a DeferredError with errors.Is
+var ErrDeferred = errors.New("Deferred Response")
+
+// DeferredError indicates a request will be handled with a Responder
+type DeferredError struct {
+}
+
+func deferredErrorNew() error {
+	return &DeferredError{}
+}
+func (e *DeferredError) Error() string {
+	return "Deferred Response"
+}
+
+// Is provides errors.Is support for ErrDeferred
+func (e *DeferredError) Is(target error) bool {
+	return target == ErrDeferred
+}
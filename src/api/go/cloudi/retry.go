@@ -0,0 +1,191 @@
+package cloudi
+
+//-*-Mode:Go;coding:utf-8;tab-width:4;c-basic-offset:4-*-
+// ex: set ft=go fenc=utf-8 sts=4 ts=4 sw=4 noet nomod:
+//
+// MIT License
+//
+// Copyright (c) 2017-2020 Michael Truog <mjtruog at protonmail dot com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+// DEALINGS IN THE SOFTWARE.
+//
+
+import (
+	"context"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// InfoKeyAttempt is the request info key that provides the attempt
+// number of a service request sent with a RetryPolicy
+const InfoKeyAttempt = "attempt"
+
+// RetryPredicate returns true if the service request should be sent again
+// (the response is nil after SendAsync sends a service request)
+type RetryPredicate func(response *Response, err error) bool
+
+// RetryPolicy determines how a service request is sent again.
+// Every attempt is limited by the service request timeout.
+type RetryPolicy struct {
+	// Attempts is the maximum number of attempts (including the first)
+	Attempts int
+	// AttemptTimeout limits the timeout of each attempt
+	// (0 uses the remaining service request timeout)
+	AttemptTimeout time.Duration
+	// Backoff is the delay before the second attempt
+	Backoff time.Duration
+	// BackoffMax limits the delay before an attempt (0 is no limit)
+	BackoffMax time.Duration
+	// Multiplier increases the delay after each attempt (0 is 2)
+	Multiplier float64
+	// Jitter is the fraction of the delay that is random (in [0..1])
+	Jitter float64
+	// Retry selects the results that are retried (nil is RetryEmpty)
+	Retry RetryPredicate
+}
+
+// WithRetry sends the service request again based on the RetryPolicy
+func WithRetry(policy RetryPolicy) SendOption {
+	return func(options *sendOptions) error {
+		if options.recv {
+			return invalidInputErrorNew("policy")
+		}
+		if policy.Attempts < 1 || policy.AttemptTimeout < 0 ||
+			policy.Backoff < 0 || policy.BackoffMax < 0 ||
+			(policy.Multiplier != 0 && policy.Multiplier < 1) ||
+			policy.Jitter < 0 || policy.Jitter > 1 {
+			return invalidInputErrorNew("policy")
+		}
+		if policy.Multiplier == 0 {
+			policy.Multiplier = 2
+		}
+		if policy.Retry == nil {
+			policy.Retry = RetryEmpty
+		}
+		options.retry = &policy
+		return nil
+	}
+}
+
+// RetryEmpty retries an empty response (e.g., a timeout)
+func RetryEmpty(response *Response, err error) bool {
+	return err == nil && response != nil &&
+		len(response.ResponseInfo) == 0 && len(response.Response) == 0
+}
+
+// RetryInfoKey retries a response with the response info key
+// (if values are provided, the key must have one of the values)
+func RetryInfoKey(key string, values ...string) RetryPredicate {
+	return func(response *Response, err error) bool {
+		if err != nil || response == nil {
+			return false
+		}
+		found, ok := InfoKeyValueParse(response.ResponseInfo)[key]
+		if !ok {
+			return false
+		}
+		if len(values) == 0 {
+			return true
+		}
+		for _, value := range found {
+			for _, valueRetry := range values {
+				if value == valueRetry {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
+// RetryAny retries if any of the predicates retries
+func RetryAny(predicates ...RetryPredicate) RetryPredicate {
+	return func(response *Response, err error) bool {
+		for _, predicate := range predicates {
+			if predicate(response, err) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// send calls the attempt function until the result is not retried,
+// the attempts are exhausted or the service request timeout expires
+func (policy *RetryPolicy) send(ctx context.Context, options *sendOptions, requestInfo []byte, attempt sendAttempt) (*Response, []byte, error) {
+	deadline := time.Now().Add(time.Duration(options.timeout) * time.Millisecond)
+	for i := 1; ; i++ {
+		timeout := time.Until(deadline)
+		if timeout < 0 {
+			timeout = 0
+		}
+		if policy.AttemptTimeout > 0 && policy.AttemptTimeout < timeout {
+			timeout = policy.AttemptTimeout
+		}
+		attemptOptions := *options
+		attemptOptions.timeout = uint32(timeout / time.Millisecond)
+		requestInfoAttempt, err := retryInfo(requestInfo, i)
+		if err != nil {
+			return nil, nil, err
+		}
+		response, transId, err := attempt(requestInfoAttempt, &attemptOptions)
+		if i >= policy.Attempts || !policy.Retry(response, err) {
+			return response, transId, err
+		}
+		delay := policy.delay(i)
+		if time.Until(deadline)-delay < time.Millisecond {
+			return response, transId, err
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return response, transId, err
+		}
+	}
+}
+
+// delay provides the exponential backoff before the next attempt
+func (policy *RetryPolicy) delay(attempt int) time.Duration {
+	delay := float64(policy.Backoff)
+	for i := 1; i < attempt; i++ {
+		delay *= policy.Multiplier
+		if policy.BackoffMax > 0 && delay >= float64(policy.BackoffMax) {
+			break
+		}
+	}
+	if policy.BackoffMax > 0 && delay > float64(policy.BackoffMax) {
+		delay = float64(policy.BackoffMax)
+	}
+	delay -= delay * policy.Jitter * rand.Float64()
+	return time.Duration(delay)
+}
+
+// retryInfo adds the attempt number to the request info
+// (if the request info is key/value data)
+func retryInfo(requestInfo []byte, attempt int) ([]byte, error) {
+	if len(requestInfo) > 0 && requestInfo[len(requestInfo)-1] != 0 {
+		return requestInfo, nil
+	}
+	pairs := InfoKeyValueParse(requestInfo)
+	pairs[InfoKeyAttempt] = []string{strconv.Itoa(attempt)}
+	return InfoKeyValueNew(pairs)
+}
@@ -0,0 +1,166 @@
+package cloudi
+
+//-*-Mode:Go;coding:utf-8;tab-width:4;c-basic-offset:4-*-
+// ex: set ft=go fenc=utf-8 sts=4 ts=4 sw=4 noet nomod:
+//
+// MIT License
+//
+// Copyright (c) 2017-2020 Michael Truog <mjtruog at protonmail dot com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+// DEALINGS IN THE SOFTWARE.
+//
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// Run creates an Instance for each thread in the service configuration
+// and calls setup and then Poll with each Instance until all terminate
+// (SIGTERM or SIGINT causes Shutdown to be called on each Instance,
+// a second SIGTERM or SIGINT exits immediately
+// and the process exits with a non-zero exit code after any errors)
+func Run(setup func(api *Instance) error) {
+	RunState(setup, nil)
+}
+
+// RunState is Run with the state provided to API for each thread
+// (state is called with each thread index, a nil state provides nil)
+func RunState(setup func(api *Instance) error, state func(threadIndex uint32) interface{}) {
+	threadCount, err := ThreadCount()
+	if err != nil {
+		ErrorExit(os.Stderr, err)
+	}
+	failed := false
+	instances := make([]*Instance, 0, threadCount)
+	for threadIndex := uint32(0); threadIndex < threadCount; threadIndex++ {
+		var api *Instance
+		var stateThread interface{}
+		if state != nil {
+			stateThread = state(threadIndex)
+		}
+		api, err = API(threadIndex, stateThread)
+		if err != nil {
+			ErrorWrite(os.Stderr, err)
+			failed = true
+			continue
+		}
+		instances = append(instances, api)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		select {
+		case <-signals:
+			// restore the default behavior for a second signal
+			signal.Stop(signals)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	err = Serve(ctx, instances, setup)
+	signal.Stop(signals)
+	cancel()
+	if err != nil {
+		for _, errThread := range err.(*RunError).Errors {
+			ErrorWrite(os.Stderr, errThread)
+		}
+		failed = true
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// Serve calls setup and then Poll with each Instance (in separate goroutines)
+// until all terminate, calling Shutdown on each Instance when the context
+// is done (termination is not an error)
+func Serve(ctx context.Context, instances []*Instance, setup func(api *Instance) error) error {
+	var execution sync.WaitGroup
+	errs := make([]error, len(instances))
+	for i, api := range instances {
+		execution.Add(1)
+		go func(i int, api *Instance) {
+			defer execution.Done()
+			errs[i] = serve(api, setup)
+		}(i, api)
+	}
+	done := make(chan struct{})
+	go func() {
+		execution.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		for _, api := range instances {
+			_ = api.Shutdown()
+		}
+		<-done
+	}
+	var errorsFound []error
+	for _, err := range errs {
+		if err != nil {
+			errorsFound = append(errorsFound, err)
+		}
+	}
+	if errorsFound == nil {
+		return nil
+	}
+	return runErrorNew(errorsFound)
+}
+
+func serve(api *Instance, setup func(api *Instance) error) error {
+	var err error
+	if setup != nil {
+		err = setup(api)
+	}
+	if err == nil {
+		_, err = api.Poll(-1)
+	}
+	if errors.Is(err, ErrTerminate) {
+		return nil
+	}
+	return err
+}
+
+// RunError provides the errors from all the threads that failed
+type RunError struct {
+	Errors []error
+}
+
+func runErrorNew(errs []error) error {
+	return &RunError{Errors: errs}
+}
+func (e *RunError) Error() string {
+	output := new(bytes.Buffer)
+	for i, err := range e.Errors {
+		if i > 0 {
+			_, _ = output.WriteString("\n")
+		}
+		_, _ = output.WriteString(err.Error())
+	}
+	return output.String()
+}
@@ -0,0 +1,285 @@
+package cloudi
+
+//-*-Mode:Go;coding:utf-8;tab-width:4;c-basic-offset:4-*-
+// ex: set ft=go fenc=utf-8 sts=4 ts=4 sw=4 noet nomod:
+//
+// MIT License
+//
+// Copyright (c) 2017-2020 Michael Truog <mjtruog at protonmail dot com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+// DEALINGS IN THE SOFTWARE.
+//
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// InfoKeyTraceParent is the request info key of the
+	// W3C Trace Context traceparent value
+	InfoKeyTraceParent = "traceparent"
+	// InfoKeyTraceState is the request info key of the
+	// W3C Trace Context tracestate value
+	InfoKeyTraceState = "tracestate"
+)
+
+// TraceContext is a W3C Trace Context
+type TraceContext struct {
+	TraceId [16]byte
+	SpanId  [8]byte
+	// Flags are the trace flags (0x01 is sampled)
+	Flags byte
+	// State is the tracestate value, if any
+	State string
+}
+
+// TraceContextParse returns the TraceContext of the
+// traceparent and tracestate values
+func TraceContextParse(traceparent, tracestate string) (TraceContext, error) {
+	var result TraceContext
+	// version 00 is 55 characters, later versions may append fields
+	if len(traceparent) < 55 || traceparent[2] != '-' ||
+		traceparent[35] != '-' || traceparent[52] != '-' ||
+		(len(traceparent) > 55 && traceparent[55] != '-') ||
+		traceparent != strings.ToLower(traceparent) {
+		return result, invalidInputErrorNew("traceparent")
+	}
+	var version [1]byte
+	var flags [1]byte
+	if _, err := hex.Decode(version[:], []byte(traceparent[0:2])); err != nil ||
+		version[0] == 0xff || (version[0] == 0 && len(traceparent) != 55) {
+		return result, invalidInputErrorNew("traceparent")
+	}
+	if _, err := hex.Decode(result.TraceId[:], []byte(traceparent[3:35])); err != nil ||
+		result.TraceId == [16]byte{} {
+		return TraceContext{}, invalidInputErrorNew("traceparent")
+	}
+	if _, err := hex.Decode(result.SpanId[:], []byte(traceparent[36:52])); err != nil ||
+		result.SpanId == [8]byte{} {
+		return TraceContext{}, invalidInputErrorNew("traceparent")
+	}
+	if _, err := hex.Decode(flags[:], []byte(traceparent[53:55])); err != nil {
+		return TraceContext{}, invalidInputErrorNew("traceparent")
+	}
+	result.Flags = flags[0]
+	result.State = strings.TrimSpace(tracestate)
+	return result, nil
+}
+
+// TraceParent returns the traceparent value
+func (trace TraceContext) TraceParent() string {
+	return "00-" + hex.EncodeToString(trace.TraceId[:]) +
+		"-" + hex.EncodeToString(trace.SpanId[:]) +
+		"-" + hex.EncodeToString([]byte{trace.Flags})
+}
+
+// IsZero returns true if the TraceContext was not set
+func (trace TraceContext) IsZero() bool {
+	return trace.TraceId == [16]byte{}
+}
+
+// traceContextInfo provides the TraceContext in the request info
+func traceContextInfo(requestInfo []byte) (TraceContext, bool) {
+	if len(requestInfo) == 0 {
+		return TraceContext{}, false
+	}
+	pairs := InfoKeyValueParse(requestInfo)
+	traceparent := pairs[InfoKeyTraceParent]
+	if len(traceparent) != 1 {
+		return TraceContext{}, false
+	}
+	trace, err := TraceContextParse(traceparent[0], strings.Join(pairs[InfoKeyTraceState], ","))
+	if err != nil {
+		return TraceContext{}, false
+	}
+	return trace, true
+}
+
+// Span is the handling of a service request by a Handler
+type Span struct {
+	// Context is the TraceContext of the Span
+	Context TraceContext
+	// Parent is the TraceContext in the request info
+	// (zero if the Span started a trace)
+	Parent TraceContext
+	// RequestType is ASYNC or SYNC
+	RequestType int
+	Name        string
+	Pattern     string
+	Start       time.Time
+	End         time.Time
+	// Err is the error returned by the Handler, if any
+	Err error
+}
+
+// SpanExporter receives each Span after the Handler returns
+// (ExportSpan is called on the Poll goroutine and should not block)
+type SpanExporter interface {
+	ExportSpan(span *Span)
+}
+
+// TraceMemoryExporter is a SpanExporter that stores each Span in memory
+// (e.g., for tests)
+type TraceMemoryExporter struct {
+	spans []*Span
+	lock  sync.Mutex
+}
+
+// ExportSpan stores the Span
+func (exporter *TraceMemoryExporter) ExportSpan(span *Span) {
+	exporter.lock.Lock()
+	exporter.spans = append(exporter.spans, span)
+	exporter.lock.Unlock()
+}
+
+// Spans returns the Spans stored
+func (exporter *TraceMemoryExporter) Spans() []*Span {
+	exporter.lock.Lock()
+	defer exporter.lock.Unlock()
+	return append([]*Span(nil), exporter.spans...)
+}
+
+// Reset removes the Spans stored
+func (exporter *TraceMemoryExporter) Reset() {
+	exporter.lock.Lock()
+	exporter.spans = nil
+	exporter.lock.Unlock()
+}
+
+type spanKey struct{}
+
+// SpanContext returns a context with the Span
+// (a service request sent with the context continues the trace)
+func SpanContext(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// SpanFromContext returns the Span of the context, if any
+func SpanFromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// TraceExporterSet starts a Span for each service request handled
+// by the Instance with the SpanExporter provided (nil stops tracing).
+// The traceparent and tracestate request info keys are used to continue
+// a trace and are added to the request info of service requests forwarded
+// or sent with the Request context (Request.Context, Request.SendSync or
+// Request.SendAsync), if the request info is empty or key/value data
+// without a traceparent.
+func (api *Instance) TraceExporterSet(exporter SpanExporter) {
+	api.lock.Lock()
+	api.traceExporter = exporter
+	api.lock.Unlock()
+}
+
+// traceStart starts a Span for the service request
+func (api *Instance) traceStart(request *Request) {
+	api.lock.Lock()
+	defer api.lock.Unlock()
+	if api.traceExporter == nil {
+		return
+	}
+	span := &Span{
+		RequestType: request.RequestType,
+		Name:        request.Name,
+		Pattern:     request.Pattern,
+		Start:       time.Now(),
+	}
+	parent, ok := traceContextInfo(request.RequestInfo)
+	if ok {
+		span.Parent = parent
+		span.Context = parent
+	} else {
+		_, _ = rand.Read(span.Context.TraceId[:])
+		span.Context.Flags = 0x01
+	}
+	_, _ = rand.Read(span.Context.SpanId[:])
+	request.span = span
+}
+
+// traceEnd provides the Span of the service request to the SpanExporter
+func (api *Instance) traceEnd(request *Request, err error) {
+	span := request.span
+	if span == nil {
+		return
+	}
+	api.lock.RLock()
+	exporter := api.traceExporter
+	api.lock.RUnlock()
+	span.End = time.Now()
+	if handlerError(err) {
+		span.Err = err
+	}
+	if exporter != nil {
+		exporter.ExportSpan(span)
+	}
+}
+
+// traceInfo adds the TraceContext of the Span of the context
+// to the request info
+func traceInfo(ctx context.Context, requestInfo []byte) []byte {
+	return traceInfoAdd(requestInfo, SpanFromContext(ctx))
+}
+
+// traceInfoForward adds the TraceContext of the Span of the
+// service request being forwarded to the request info
+func (api *Instance) traceInfoForward(transId [16]byte, requestInfo []byte) []byte {
+	request := api.activeGet(transId)
+	if request == nil {
+		return requestInfo
+	}
+	return traceInfoAdd(requestInfo, request.span)
+}
+
+func traceInfoAdd(requestInfo []byte, span *Span) []byte {
+	if span == nil {
+		return requestInfo
+	}
+	if len(requestInfo) == 1 && requestInfo[0] == 0 {
+		// empty key/value data
+		requestInfo = nil
+	}
+	if len(requestInfo) > 0 {
+		// only key/value data is modified
+		if requestInfo[len(requestInfo)-1] != 0 ||
+			bytes.Count(requestInfo, []byte{0})%2 != 0 {
+			return requestInfo
+		}
+		if _, found := InfoKeyValueParse(requestInfo)[InfoKeyTraceParent]; found {
+			return requestInfo
+		}
+	}
+	result := make([]byte, 0, len(requestInfo)+128+len(span.Context.State))
+	result = append(result, requestInfo...)
+	result = append(result, InfoKeyTraceParent+"\x00"+span.Context.TraceParent()+"\x00"...)
+	if span.Context.State != "" {
+		result = append(result, InfoKeyTraceState+"\x00"+span.Context.State+"\x00"...)
+	}
+	return result
+}
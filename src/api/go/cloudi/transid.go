@@ -0,0 +1,172 @@
+package cloudi
+
+//-*-Mode:Go;coding:utf-8;tab-width:4;c-basic-offset:4-*-
+// ex: set ft=go fenc=utf-8 sts=4 ts=4 sw=4 noet nomod:
+//
+// MIT License
+//
+// Copyright (c) 2017-2020 Michael Truog <mjtruog at protonmail dot com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+// DEALINGS IN THE SOFTWARE.
+//
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// gregorianEpochOffset is the number of 100 nanosecond intervals
+// from the start of the Gregorian calendar to the UNIX epoch
+const gregorianEpochOffset = 0x01b21dd213814000
+
+// TransId is the transaction id of a service request
+// (a version 1 UUID created by the CloudI core)
+type TransId [16]byte
+
+// TransIdNew returns the TransId of a trans id provided as []byte
+func TransIdNew(value []byte) (TransId, error) {
+	var transId TransId
+	if len(value) != 16 {
+		return transId, invalidInputErrorNew("value")
+	}
+	copy(transId[:], value)
+	return transId, nil
+}
+
+// TransIdParse returns the TransId of the canonical UUID string format
+func TransIdParse(text string) (TransId, error) {
+	var transId TransId
+	if len(text) != 36 ||
+		text[8] != '-' || text[13] != '-' ||
+		text[18] != '-' || text[23] != '-' {
+		return transId, invalidInputErrorNew("text")
+	}
+	_, err := hex.Decode(transId[:], []byte(text[0:8]+text[9:13]+text[14:18]+text[19:23]+text[24:36]))
+	if err != nil {
+		return TransId{}, invalidInputErrorNew("text")
+	}
+	return transId, nil
+}
+
+// String returns the canonical UUID string format
+func (transId TransId) String() string {
+	text := hex.EncodeToString(transId[:])
+	return text[0:8] + "-" + text[8:12] + "-" + text[12:16] + "-" + text[16:20] + "-" + text[20:32]
+}
+
+// IsZero returns true for the null trans id that is provided
+// when a service request times out
+func (transId TransId) IsZero() bool {
+	return transId == TransId{}
+}
+
+// Time returns the timestamp of the version 1 UUID
+// (with microsecond precision, like the CloudI core)
+// or the zero time.Time if the TransId is not a version 1 UUID
+func (transId TransId) Time() time.Time {
+	value, ok := transId.timestamp()
+	if !ok {
+		return time.Time{}
+	}
+	microseconds := (int64(value) - gregorianEpochOffset) / 10
+	return time.UnixMicro(microseconds)
+}
+
+// timestamp provides the 60 bit version 1 UUID timestamp
+// for either the RFC 4122 variant or the ordered variant
+func (transId TransId) timestamp() (uint64, bool) {
+	if transId[6]>>4 != 1 {
+		return 0, false
+	}
+	switch {
+	case transId[8]>>6 == 2:
+		// RFC 4122 variant
+		low := uint64(binary.BigEndian.Uint32(transId[0:4]))
+		mid := uint64(binary.BigEndian.Uint16(transId[4:6]))
+		high := uint64(binary.BigEndian.Uint16(transId[6:8]) & 0x0fff)
+		return high<<48 | mid<<32 | low, true
+	case transId[8]>>5 == 7:
+		// ordered variant
+		high := binary.BigEndian.Uint64(append([]byte{0, 0}, transId[0:6]...))
+		low := uint64(binary.BigEndian.Uint16(transId[6:8]) & 0x0fff)
+		return high<<12 | low, true
+	default:
+		return 0, false
+	}
+}
+
+// Compare orders trans ids by timestamp (and then by value)
+// to return -1, 0 or 1
+func (transId TransId) Compare(other TransId) int {
+	time1, _ := transId.timestamp()
+	time2, _ := other.timestamp()
+	switch {
+	case time1 < time2:
+		return -1
+	case time1 > time2:
+		return 1
+	default:
+		return bytes.Compare(transId[:], other[:])
+	}
+}
+
+// TransIdGenerator creates version 1 UUIDs in the same format as the
+// CloudI core (e.g., for a fake CloudI core used by tests)
+type TransIdGenerator struct {
+	node     [6]byte
+	clockSeq uint16
+	last     int64
+	lock     sync.Mutex
+}
+
+// TransIdGeneratorNew creates a TransIdGenerator with a random node id
+func TransIdGeneratorNew() (*TransIdGenerator, error) {
+	generator := &TransIdGenerator{}
+	var random [8]byte
+	_, err := rand.Read(random[:])
+	if err != nil {
+		return nil, err
+	}
+	copy(generator.node[:], random[0:6])
+	generator.clockSeq = binary.BigEndian.Uint16(random[6:8]) & 0x3fff
+	return generator, nil
+}
+
+// Next returns a TransId with a timestamp that always increases
+func (generator *TransIdGenerator) Next() TransId {
+	generator.lock.Lock()
+	microseconds := time.Now().UnixMicro()
+	if microseconds <= generator.last {
+		microseconds = generator.last + 1
+	}
+	generator.last = microseconds
+	generator.lock.Unlock()
+	value := uint64(microseconds)*10 + gregorianEpochOffset
+	var transId TransId
+	binary.BigEndian.PutUint32(transId[0:4], uint32(value))
+	binary.BigEndian.PutUint16(transId[4:6], uint16(value>>32))
+	binary.BigEndian.PutUint16(transId[6:8], 0x1000|uint16(value>>48)&0x0fff)
+	binary.BigEndian.PutUint16(transId[8:10], 0x8000|generator.clockSeq)
+	copy(transId[10:16], generator.node[:])
+	return transId
+}
@@ -0,0 +1,1063 @@
+package clouditest
+
+//-*-Mode:Go;coding:utf-8;tab-width:4;c-basic-offset:4-*-
+// ex: set ft=go fenc=utf-8 sts=4 ts=4 sw=4 noet nomod:
+//
+// MIT License
+//
+// Copyright (c) 2017-2020 Michael Truog <mjtruog at protonmail dot com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+// DEALINGS IN THE SOFTWARE.
+//
+
+import (
+	"bytes"
+	"cloudi"
+	"encoding/binary"
+	"erlang"
+	"math/big"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	messageInit           = 1
+	messageSendAsync      = 2
+	messageSendSync       = 3
+	messageRecvAsync      = 4
+	messageReturnAsync    = 5
+	messageReturnSync     = 6
+	messageReturnsAsync   = 7
+	messageKeepalive      = 8
+	messageReinit         = 9
+	messageSubscribeCount = 10
+	messageTerm           = 11
+)
+
+var nativeEndian binary.ByteOrder
+
+func init() {
+	switch byteOrder := uint16(0x00ff); *(*uint8)(unsafe.Pointer(&byteOrder)) {
+	case 0x00:
+		nativeEndian = binary.BigEndian
+	case 0xff:
+		nativeEndian = binary.LittleEndian
+	}
+}
+
+// Config provides the service configuration the fake CloudI core sends during initialization
+type Config struct {
+	ProcessIndex      uint32
+	ProcessCount      uint32
+	ProcessCountMax   uint32
+	ProcessCountMin   uint32
+	Prefix            string
+	TimeoutInitialize uint32
+	TimeoutAsync      uint32
+	TimeoutSync       uint32
+	TimeoutTerminate  uint32
+	PriorityDefault   int8
+	BufferSize        uint32
+}
+
+// ConfigDefault returns the CloudI service configuration defaults
+func ConfigDefault() Config {
+	return Config{
+		ProcessIndex:      0,
+		ProcessCount:      1,
+		ProcessCountMax:   1,
+		ProcessCountMin:   1,
+		Prefix:            "/",
+		TimeoutInitialize: 5000,
+		TimeoutAsync:      5000,
+		TimeoutSync:       5000,
+		TimeoutTerminate:  2000,
+		PriorityDefault:   0,
+		BufferSize:        65536,
+	}
+}
+
+// Message is a message the service sent to the fake CloudI core
+type Message struct {
+	// Command is the name of the message
+	// (e.g., "send_sync", "return_async", "forward_sync", "recv_async")
+	Command      string
+	Name         string
+	Pattern      string
+	RequestInfo  []byte
+	Request      []byte
+	ResponseInfo []byte
+	Response     []byte
+	Timeout      uint32
+	Priority     int8
+	TransId      [16]byte
+	Consume      bool
+	Reason       string
+}
+
+// Request is a service request the fake CloudI core sends to the service
+type Request struct {
+	// RequestType is cloudi.ASYNC or cloudi.SYNC
+	RequestType int
+	Name        string
+	// Pattern defaults to Name
+	Pattern     string
+	RequestInfo []byte
+	Request     []byte
+	// Timeout defaults to the TimeoutAsync or TimeoutSync configuration
+	Timeout  uint32
+	Priority int8
+	// TransId is created if it is not provided
+	TransId [16]byte
+}
+
+// Result is the return or forward the service provided for a Request
+type Result struct {
+	// Command is "return_async", "return_sync",
+	// "forward_async" or "forward_sync"
+	Command string
+	Message
+}
+
+// Forwarded returns true if the service forwarded the service request
+func (result *Result) Forwarded() bool {
+	return result.Command == "forward_async" || result.Command == "forward_sync"
+}
+
+// ResponseFunction provides the response for a service request the service sends,
+// with a nil response handled as a timeout
+type ResponseFunction func(request *Message) ([]byte, []byte)
+
+type asyncResponse struct {
+	transId      [16]byte
+	responseInfo []byte
+	response     []byte
+	ready        bool
+}
+
+// Core is an in-process fake CloudI core connected to a single service thread,
+// so CloudI Go services can be tested without an Erlang node.
+// The fake core speaks the frame protocol the CloudI core uses with
+// an external service thread over a socketpair.
+// Service requests sent by the service are answered with
+// the functions registered with Respond and
+// every message the service sends is recorded for inspection.
+// Service requests sent to the service are delivered immediately,
+// without the request queue the CloudI core uses.
+type Core struct {
+	config        Config
+	socket        net.Conn
+	fdService     int
+	apiCalled     bool
+	lock          sync.Mutex
+	sendLock      sync.Mutex
+	polling       chan struct{}
+	pollingOnce   sync.Once
+	keepalive     chan struct{}
+	done          chan struct{}
+	err           error
+	messages      []Message
+	subscriptions map[string]uint32
+	responses     map[string][]ResponseFunction
+	responsesNext map[string]int
+	results       map[[16]byte]chan *Result
+	async         []*asyncResponse
+	asyncChanged  chan struct{}
+	transIds      *cloudi.TransIdGenerator
+	pid           erlang.OtpErlangPid
+}
+
+// New creates a fake CloudI core
+func New(config Config) (*Core, error) {
+	if config.BufferSize == 0 {
+		return nil, inputErrorNew("BufferSize == 0")
+	}
+	transIds, err := cloudi.TransIdGeneratorNew()
+	if err != nil {
+		return nil, err
+	}
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	fileCore := os.NewFile(uintptr(fds[0]), "clouditest core")
+	var socket net.Conn
+	socket, err = net.FileConn(fileCore)
+	_ = fileCore.Close()
+	if err != nil {
+		_ = syscall.Close(fds[1])
+		return nil, err
+	}
+	core := &Core{
+		config:        config,
+		socket:        socket,
+		fdService:     fds[1],
+		polling:       make(chan struct{}),
+		keepalive:     make(chan struct{}, 1),
+		done:          make(chan struct{}),
+		subscriptions: make(map[string]uint32),
+		responses:     make(map[string][]ResponseFunction),
+		responsesNext: make(map[string]int),
+		results:       make(map[[16]byte]chan *Result),
+		asyncChanged:  make(chan struct{}),
+		transIds:      transIds,
+		pid: erlang.OtpErlangPid{
+			NodeTag:  100,
+			Node:     []byte("\x00\x0dnonode@nohost"),
+			ID:       []byte{0, 0, 0, 59},
+			Serial:   []byte{0, 0, 0, 0},
+			Creation: []byte{0}},
+	}
+	go core.recvLoop()
+	return core, nil
+}
+
+// API creates the CloudI API instance of the service thread connected to the fake CloudI core
+func (core *Core) API(state interface{}) (*cloudi.Instance, error) {
+	core.lock.Lock()
+	if core.apiCalled {
+		core.lock.Unlock()
+		return nil, inputErrorNew("API already called")
+	}
+	core.apiCalled = true
+	core.lock.Unlock()
+	// the environment variables are only set while cloudi.API is called
+	environmentLock.Lock()
+	defer environmentLock.Unlock()
+	restore, err := environmentSet(map[string]string{
+		"CLOUDI_API_INIT_PROTOCOL":    "local",
+		"CLOUDI_API_INIT_BUFFER_SIZE": strconv.FormatUint(uint64(core.config.BufferSize), 10),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer restore()
+	// cloudi.API uses the file descriptor threadIndex + 3
+	// (the service socket file descriptor is owned by cloudi.API)
+	return cloudi.API(uint32(core.fdService-3), state)
+}
+
+// environmentLock serializes the use of the process environment
+// by separate fake CloudI cores
+var environmentLock sync.Mutex
+
+// environmentSet sets the environment variables and provides a function
+// to restore the previous environment
+func environmentSet(values map[string]string) (func(), error) {
+	previous := map[string]*string{}
+	restore := func() {
+		for key, value := range previous {
+			if value == nil {
+				_ = os.Unsetenv(key)
+			} else {
+				_ = os.Setenv(key, *value)
+			}
+		}
+	}
+	for key, value := range values {
+		if old, found := os.LookupEnv(key); found {
+			previous[key] = &old
+		} else {
+			previous[key] = nil
+		}
+		err := os.Setenv(key, value)
+		if err != nil {
+			restore()
+			return nil, err
+		}
+	}
+	return restore, nil
+}
+
+// Close closes the connection to the service
+func (core *Core) Close() error {
+	core.lock.Lock()
+	apiCalled := core.apiCalled
+	core.apiCalled = true
+	core.lock.Unlock()
+	if !apiCalled {
+		_ = syscall.Close(core.fdService)
+	}
+	err := core.socket.Close()
+	<-core.done
+	return err
+}
+
+// Err returns the error that stopped the fake CloudI core
+func (core *Core) Err() error {
+	select {
+	case <-core.done:
+		core.lock.Lock()
+		defer core.lock.Unlock()
+		return core.err
+	default:
+		return nil
+	}
+}
+
+// Respond provides responses for service requests the service sends to the service name
+func (core *Core) Respond(name string, function ResponseFunction) {
+	core.lock.Lock()
+	core.responses[name] = append(core.responses[name], function)
+	core.lock.Unlock()
+}
+
+// Messages returns the messages the service sent with the command provided
+// (or all messages if command is "")
+func (core *Core) Messages(command string) []Message {
+	core.lock.Lock()
+	defer core.lock.Unlock()
+	messages := []Message{}
+	for _, message := range core.messages {
+		if command == "" || message.Command == command {
+			messages = append(messages, message)
+		}
+	}
+	return messages
+}
+
+// Subscriptions returns the subscription count of each service name pattern
+func (core *Core) Subscriptions() map[string]uint32 {
+	core.lock.Lock()
+	defer core.lock.Unlock()
+	subscriptions := make(map[string]uint32, len(core.subscriptions))
+	for pattern, count := range core.subscriptions {
+		subscriptions[pattern] = count
+	}
+	return subscriptions
+}
+
+// WaitPolling blocks until the service has completed initialization
+func (core *Core) WaitPolling(timeout time.Duration) error {
+	select {
+	case <-core.polling:
+		return nil
+	case <-core.done:
+		return core.Err()
+	case <-time.After(timeout):
+		return timeoutErrorNew()
+	}
+}
+
+// Send sends a service request to the service and blocks for its result
+func (core *Core) Send(request Request) (*Result, error) {
+	var command uint32
+	switch request.RequestType {
+	case cloudi.ASYNC:
+		command = messageSendAsync
+		if request.Timeout == 0 {
+			request.Timeout = core.config.TimeoutAsync
+		}
+	case cloudi.SYNC:
+		command = messageSendSync
+		if request.Timeout == 0 {
+			request.Timeout = core.config.TimeoutSync
+		}
+	default:
+		return nil, inputErrorNew("invalid RequestType")
+	}
+	if request.Name == "" {
+		return nil, inputErrorNew("invalid Name")
+	}
+	if request.Pattern == "" {
+		request.Pattern = request.Name
+	}
+	if request.TransId == ([16]byte{}) {
+		request.TransId = core.transIdNew()
+	}
+	err := core.WaitPolling(time.Duration(request.Timeout) * time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	resultChannel := make(chan *Result, 1)
+	core.lock.Lock()
+	core.results[request.TransId] = resultChannel
+	core.lock.Unlock()
+	defer func() {
+		core.lock.Lock()
+		delete(core.results, request.TransId)
+		core.lock.Unlock()
+	}()
+	var pid []byte
+	pid, err = erlang.TermToBinary(core.pid, -1)
+	if err != nil {
+		return nil, err
+	}
+	buffer := new(bytes.Buffer)
+	frameUint32(buffer, command)
+	frameString(buffer, request.Name)
+	frameString(buffer, request.Pattern)
+	frameBinary(buffer, request.RequestInfo)
+	frameBinary(buffer, request.Request)
+	frameUint32(buffer, request.Timeout)
+	_ = binary.Write(buffer, nativeEndian, request.Priority)
+	_, _ = buffer.Write(request.TransId[:])
+	frameUint32(buffer, uint32(len(pid)))
+	_, _ = buffer.Write(pid)
+	err = core.send(buffer.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case result := <-resultChannel:
+		return result, nil
+	case <-core.done:
+		return nil, core.Err()
+	case <-time.After(time.Duration(request.Timeout) * time.Millisecond):
+		return nil, timeoutErrorNew()
+	}
+}
+
+// SendAsync sends an asynchronous service request to the service and blocks for its result
+func (core *Core) SendAsync(name string, requestInfo, request []byte) (*Result, error) {
+	return core.Send(Request{RequestType: cloudi.ASYNC, Name: name, RequestInfo: requestInfo, Request: request})
+}
+
+// SendSync sends a synchronous service request to the service and blocks for its result
+func (core *Core) SendSync(name string, requestInfo, request []byte) (*Result, error) {
+	return core.Send(Request{RequestType: cloudi.SYNC, Name: name, RequestInfo: requestInfo, Request: request})
+}
+
+// Keepalive sends a keepalive to the service and blocks for the reply
+func (core *Core) Keepalive(timeout time.Duration) error {
+	buffer := new(bytes.Buffer)
+	frameUint32(buffer, messageKeepalive)
+	err := core.send(buffer.Bytes())
+	if err != nil {
+		return err
+	}
+	select {
+	case <-core.keepalive:
+		return nil
+	case <-core.done:
+		return core.Err()
+	case <-time.After(timeout):
+		return timeoutErrorNew()
+	}
+}
+
+// Reinit sends a change in the service configuration to the service
+func (core *Core) Reinit(processCount, timeoutAsync, timeoutSync uint32, priorityDefault int8) error {
+	core.lock.Lock()
+	core.config.ProcessCount = processCount
+	core.config.TimeoutAsync = timeoutAsync
+	core.config.TimeoutSync = timeoutSync
+	core.config.PriorityDefault = priorityDefault
+	core.lock.Unlock()
+	buffer := new(bytes.Buffer)
+	frameUint32(buffer, messageReinit)
+	frameUint32(buffer, processCount)
+	frameUint32(buffer, timeoutAsync)
+	frameUint32(buffer, timeoutSync)
+	_ = binary.Write(buffer, nativeEndian, priorityDefault)
+	return core.send(buffer.Bytes())
+}
+
+// SendRaw sends a message with the command provided and any data
+// to the service without validation (e.g., to test decoding errors)
+func (core *Core) SendRaw(command uint32, data []byte) error {
+	buffer := new(bytes.Buffer)
+	frameUint32(buffer, command)
+	_, _ = buffer.Write(data)
+	return core.send(buffer.Bytes())
+}
+
+// Terminate sends termination to the service
+func (core *Core) Terminate() error {
+	buffer := new(bytes.Buffer)
+	frameUint32(buffer, messageTerm)
+	return core.send(buffer.Bytes())
+}
+
+func (core *Core) recvLoop() {
+	var err error
+	defer func() {
+		core.lock.Lock()
+		core.err = err
+		core.lock.Unlock()
+		close(core.done)
+	}()
+	for {
+		var data []byte
+		data, err = core.recv()
+		if err != nil {
+			return
+		}
+		var term interface{}
+		term, err = erlang.BinaryToTerm(data)
+		if err != nil {
+			return
+		}
+		err = core.handle(term)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (core *Core) handle(term interface{}) error {
+	switch value := term.(type) {
+	case erlang.OtpErlangAtom:
+		switch value {
+		case "init":
+			return core.sendInit()
+		case "polling":
+			core.pollingOnce.Do(func() {
+				close(core.polling)
+			})
+			return nil
+		case "keepalive":
+			select {
+			case core.keepalive <- struct{}{}:
+			default:
+			}
+			return nil
+		}
+	case erlang.OtpErlangTuple:
+		if len(value) == 0 {
+			return parseErrorNew("empty tuple")
+		}
+		command, ok := value[0].(erlang.OtpErlangAtom)
+		if !ok {
+			return parseErrorNew("invalid command")
+		}
+		return core.handleCommand(string(command), value[1:])
+	}
+	return parseErrorNew("invalid message")
+}
+
+func (core *Core) handleCommand(command string, args []interface{}) error {
+	var err error
+	message := Message{Command: command}
+	switch command {
+	case "subscribe", "unsubscribe", "subscribe_count":
+		if len(args) != 1 {
+			return parseErrorNew(command)
+		}
+		var pattern string
+		pattern, err = termString(args[0])
+		if err != nil {
+			return err
+		}
+		message.Pattern = core.config.Prefix + pattern
+		core.lock.Lock()
+		core.messages = append(core.messages, message)
+		count := core.subscriptions[message.Pattern]
+		switch command {
+		case "subscribe":
+			core.subscriptions[message.Pattern] = count + 1
+		case "unsubscribe":
+			if count <= 1 {
+				delete(core.subscriptions, message.Pattern)
+			} else {
+				core.subscriptions[message.Pattern] = count - 1
+			}
+		}
+		core.lock.Unlock()
+		if command == "subscribe_count" {
+			buffer := new(bytes.Buffer)
+			frameUint32(buffer, messageSubscribeCount)
+			frameUint32(buffer, count)
+			return core.send(buffer.Bytes())
+		}
+		return nil
+	case "send_async", "send_sync", "mcast_async":
+		if len(args) != 5 {
+			return parseErrorNew(command)
+		}
+		message.Name, err = termString(args[0])
+		if err != nil {
+			return err
+		}
+		message.RequestInfo, err = termBinary(args[1])
+		if err != nil {
+			return err
+		}
+		message.Request, err = termBinary(args[2])
+		if err != nil {
+			return err
+		}
+		message.Timeout, err = termUint32(args[3])
+		if err != nil {
+			return err
+		}
+		message.Priority, err = termInt8(args[4])
+		if err != nil {
+			return err
+		}
+		core.request(&message)
+		return nil
+	case "forward_async", "forward_sync":
+		if len(args) != 7 {
+			return parseErrorNew(command)
+		}
+		message.Name, err = termString(args[0])
+		if err != nil {
+			return err
+		}
+		message.RequestInfo, err = termBinary(args[1])
+		if err != nil {
+			return err
+		}
+		message.Request, err = termBinary(args[2])
+		if err != nil {
+			return err
+		}
+		message.Timeout, err = termUint32(args[3])
+		if err != nil {
+			return err
+		}
+		message.Priority, err = termInt8(args[4])
+		if err != nil {
+			return err
+		}
+		message.TransId, err = termTransId(args[5])
+		if err != nil {
+			return err
+		}
+		core.result(&message)
+		return nil
+	case "return_async", "return_sync":
+		if len(args) != 7 {
+			return parseErrorNew(command)
+		}
+		message.Name, err = termString(args[0])
+		if err != nil {
+			return err
+		}
+		message.Pattern, err = termString(args[1])
+		if err != nil {
+			return err
+		}
+		message.ResponseInfo, err = termBinary(args[2])
+		if err != nil {
+			return err
+		}
+		message.Response, err = termBinary(args[3])
+		if err != nil {
+			return err
+		}
+		message.Timeout, err = termUint32(args[4])
+		if err != nil {
+			return err
+		}
+		message.TransId, err = termTransId(args[5])
+		if err != nil {
+			return err
+		}
+		core.result(&message)
+		return nil
+	case "recv_async":
+		if len(args) != 3 {
+			return parseErrorNew(command)
+		}
+		message.Timeout, err = termUint32(args[0])
+		if err != nil {
+			return err
+		}
+		message.TransId, err = termTransId(args[1])
+		if err != nil {
+			return err
+		}
+		consume, ok := args[2].(erlang.OtpErlangAtom)
+		if !ok || (consume != "true" && consume != "false") {
+			return parseErrorNew("invalid consume")
+		}
+		message.Consume = (consume == "true")
+		core.lock.Lock()
+		core.messages = append(core.messages, message)
+		core.lock.Unlock()
+		go core.recvAsync(message.Timeout, message.TransId, message.Consume)
+		return nil
+	case "shutdown":
+		if len(args) != 1 {
+			return parseErrorNew(command)
+		}
+		message.Reason, err = termString(args[0])
+		if err != nil {
+			return err
+		}
+		core.lock.Lock()
+		core.messages = append(core.messages, message)
+		core.lock.Unlock()
+		return nil
+	}
+	return parseErrorNew("unknown command " + command)
+}
+
+func (core *Core) request(message *Message) {
+	core.lock.Lock()
+	core.messages = append(core.messages, *message)
+	functions := core.responses[message.Name]
+	next := core.responsesNext[message.Name]
+	if len(functions) > 0 {
+		core.responsesNext[message.Name] = (next + 1) % len(functions)
+	}
+	core.lock.Unlock()
+	switch message.Command {
+	case "send_async":
+		buffer := new(bytes.Buffer)
+		frameUint32(buffer, messageReturnAsync)
+		if len(functions) == 0 {
+			_, _ = buffer.Write(make([]byte, 16))
+		} else {
+			transId := core.asyncNew(message, functions[next%len(functions)])
+			_, _ = buffer.Write(transId[:])
+		}
+		_ = core.send(buffer.Bytes())
+	case "mcast_async":
+		buffer := new(bytes.Buffer)
+		frameUint32(buffer, messageReturnsAsync)
+		frameUint32(buffer, uint32(len(functions)))
+		for _, function := range functions {
+			transId := core.asyncNew(message, function)
+			_, _ = buffer.Write(transId[:])
+		}
+		_ = core.send(buffer.Bytes())
+	case "send_sync":
+		if len(functions) == 0 {
+			_ = core.send(returnSyncFrame(nil, nil, [16]byte{}))
+			return
+		}
+		transId := core.transIdNew()
+		function := functions[next%len(functions)]
+		go func() {
+			responseInfo, response, ok := core.respond(message, function)
+			if !ok {
+				// a timeout has a null trans id
+				_ = core.send(returnSyncFrame(nil, nil, [16]byte{}))
+				return
+			}
+			_ = core.send(returnSyncFrame(responseInfo, response, transId))
+		}()
+	}
+}
+
+func (core *Core) respond(message *Message, function ResponseFunction) ([]byte, []byte, bool) {
+	type response struct {
+		responseInfo []byte
+		response     []byte
+	}
+	responseChannel := make(chan response, 1)
+	request := *message
+	go func() {
+		responseInfo, responseValue := function(&request)
+		responseChannel <- response{responseInfo, responseValue}
+	}()
+	select {
+	case value := <-responseChannel:
+		if value.response == nil {
+			return nil, nil, false
+		}
+		return value.responseInfo, value.response, true
+	case <-time.After(time.Duration(message.Timeout) * time.Millisecond):
+		return nil, nil, false
+	case <-core.done:
+		return nil, nil, false
+	}
+}
+
+func (core *Core) asyncNew(message *Message, function ResponseFunction) [16]byte {
+	transId := core.transIdNew()
+	entry := &asyncResponse{transId: transId}
+	core.lock.Lock()
+	core.async = append(core.async, entry)
+	core.lock.Unlock()
+	go func() {
+		responseInfo, response, ok := core.respond(message, function)
+		core.lock.Lock()
+		if ok {
+			entry.responseInfo = responseInfo
+			entry.response = response
+			entry.ready = true
+		} else {
+			core.asyncRemove(entry)
+		}
+		core.asyncNotify()
+		core.lock.Unlock()
+	}()
+	return transId
+}
+
+// asyncRemove requires the core lock
+func (core *Core) asyncRemove(entry *asyncResponse) {
+	for i, value := range core.async {
+		if value == entry {
+			core.async = append(core.async[:i], core.async[i+1:]...)
+			return
+		}
+	}
+}
+
+// asyncNotify requires the core lock
+func (core *Core) asyncNotify() {
+	close(core.asyncChanged)
+	core.asyncChanged = make(chan struct{})
+}
+
+func (core *Core) recvAsync(timeout uint32, transId [16]byte, consume bool) {
+	timer := time.NewTimer(time.Duration(timeout) * time.Millisecond)
+	defer timer.Stop()
+	for {
+		var found *asyncResponse
+		core.lock.Lock()
+		for _, entry := range core.async {
+			if entry.ready && (transId == [16]byte{} || entry.transId == transId) {
+				found = entry
+				break
+			}
+		}
+		if found != nil && consume {
+			core.asyncRemove(found)
+		}
+		changed := core.asyncChanged
+		core.lock.Unlock()
+		if found != nil {
+			_ = core.send(recvAsyncFrame(found.responseInfo, found.response, found.transId))
+			return
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			_ = core.send(recvAsyncFrame(nil, nil, transId))
+			return
+		case <-core.done:
+			return
+		}
+	}
+}
+
+func (core *Core) result(message *Message) {
+	core.lock.Lock()
+	core.messages = append(core.messages, *message)
+	resultChannel := core.results[message.TransId]
+	delete(core.results, message.TransId)
+	core.lock.Unlock()
+	if resultChannel != nil {
+		resultChannel <- &Result{Command: message.Command, Message: *message}
+	}
+}
+
+func (core *Core) sendInit() error {
+	core.lock.Lock()
+	config := core.config
+	core.lock.Unlock()
+	buffer := new(bytes.Buffer)
+	frameUint32(buffer, messageInit)
+	frameUint32(buffer, config.ProcessIndex)
+	frameUint32(buffer, config.ProcessCount)
+	frameUint32(buffer, config.ProcessCountMax)
+	frameUint32(buffer, config.ProcessCountMin)
+	frameString(buffer, config.Prefix)
+	frameUint32(buffer, config.TimeoutInitialize)
+	frameUint32(buffer, config.TimeoutAsync)
+	frameUint32(buffer, config.TimeoutSync)
+	frameUint32(buffer, config.TimeoutTerminate)
+	_ = binary.Write(buffer, nativeEndian, config.PriorityDefault)
+	return core.send(buffer.Bytes())
+}
+
+func (core *Core) transIdNew() [16]byte {
+	return core.transIds.Next()
+}
+
+func (core *Core) send(data []byte) error {
+	buffer := new(bytes.Buffer)
+	buffer.Grow(4 + len(data))
+	_ = binary.Write(buffer, binary.BigEndian, uint32(len(data)))
+	_, _ = buffer.Write(data)
+	core.sendLock.Lock()
+	defer core.sendLock.Unlock()
+	_, err := core.socket.Write(buffer.Bytes())
+	return err
+}
+
+func (core *Core) recv() ([]byte, error) {
+	header := make([]byte, 4)
+	_, err := readFull(core.socket, header)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(header))
+	_, err = readFull(core.socket, data)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func readFull(socket net.Conn, data []byte) (int, error) {
+	total := 0
+	for total < len(data) {
+		i, err := socket.Read(data[total:])
+		total += i
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func returnSyncFrame(responseInfo, response []byte, transId [16]byte) []byte {
+	buffer := new(bytes.Buffer)
+	frameUint32(buffer, messageReturnSync)
+	frameBinary(buffer, responseInfo)
+	frameBinary(buffer, response)
+	_, _ = buffer.Write(transId[:])
+	return buffer.Bytes()
+}
+
+func recvAsyncFrame(responseInfo, response []byte, transId [16]byte) []byte {
+	buffer := new(bytes.Buffer)
+	frameUint32(buffer, messageRecvAsync)
+	frameBinary(buffer, responseInfo)
+	frameBinary(buffer, response)
+	_, _ = buffer.Write(transId[:])
+	return buffer.Bytes()
+}
+
+func frameUint32(buffer *bytes.Buffer, value uint32) {
+	_ = binary.Write(buffer, nativeEndian, value)
+}
+
+func frameString(buffer *bytes.Buffer, value string) {
+	frameUint32(buffer, uint32(len(value)+1))
+	_, _ = buffer.WriteString(value)
+	_ = buffer.WriteByte(0)
+}
+
+func frameBinary(buffer *bytes.Buffer, value []byte) {
+	frameUint32(buffer, uint32(len(value)))
+	_, _ = buffer.Write(value)
+	_ = buffer.WriteByte(0)
+}
+
+func termString(term interface{}) (string, error) {
+	switch value := term.(type) {
+	case string:
+		return value, nil
+	case erlang.OtpErlangList:
+		characters := make([]byte, len(value.Value))
+		for i, character := range value.Value {
+			c, ok := character.(uint8)
+			if !ok || value.Improper {
+				return "", parseErrorNew("invalid string")
+			}
+			characters[i] = c
+		}
+		return string(characters), nil
+	}
+	return "", parseErrorNew("invalid string")
+}
+
+func termBinary(term interface{}) ([]byte, error) {
+	if value, ok := term.(erlang.OtpErlangBinary); ok && value.Bits == 8 {
+		return value.Value, nil
+	}
+	return nil, parseErrorNew("invalid binary")
+}
+
+func termTransId(term interface{}) ([16]byte, error) {
+	var transId [16]byte
+	value, err := termBinary(term)
+	if err != nil {
+		return transId, err
+	}
+	if len(value) != 16 {
+		return transId, parseErrorNew("invalid trans_id")
+	}
+	copy(transId[:], value)
+	return transId, nil
+}
+
+func termInteger(term interface{}) (int64, error) {
+	switch value := term.(type) {
+	case uint8:
+		return int64(value), nil
+	case int32:
+		return int64(value), nil
+	case *big.Int:
+		if value.IsInt64() {
+			return value.Int64(), nil
+		}
+	}
+	return 0, parseErrorNew("invalid integer")
+}
+
+func termUint32(term interface{}) (uint32, error) {
+	value, err := termInteger(term)
+	if err != nil {
+		return 0, err
+	}
+	if value < 0 || value > 4294967295 {
+		return 0, parseErrorNew("invalid uint32")
+	}
+	return uint32(value), nil
+}
+
+func termInt8(term interface{}) (int8, error) {
+	value, err := termInteger(term)
+	if err != nil {
+		return 0, err
+	}
+	if value < -128 || value > 127 {
+		return 0, parseErrorNew("invalid int8")
+	}
+	return int8(value), nil
+}
+
+// InputError indicates that invalid input was provided
+type InputError struct {
+	message string
+}
+
+func inputErrorNew(message string) error {
+	return &InputError{message}
+}
+func (e *InputError) Error() string {
+	return e.message
+}
+
+// ParseError indicates the service sent an invalid message
+type ParseError struct {
+	message string
+}
+
+func parseErrorNew(message string) error {
+	return &ParseError{message}
+}
+func (e *ParseError) Error() string {
+	return e.message
+}
+
+// TimeoutError indicates the service did not respond before the timeout
+type TimeoutError struct {
+}
+
+func timeoutErrorNew() error {
+	return &TimeoutError{}
+}
+func (e *TimeoutError) Error() string {
+	return "Timeout"
+}
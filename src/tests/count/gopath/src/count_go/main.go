@@ -30,45 +30,28 @@ import (
 	"cloudi"
 	"fmt"
 	"os"
-	"sync"
 )
 
 type serviceState struct {
 	count uint32
 }
 
-func request(requestType int, name, pattern string, requestInfo, request []byte, timeout uint32, priority int8, transId [16]byte, pid cloudi.Source, state interface{}, api *cloudi.Instance) ([]byte, []byte, error) {
-	stateP := state.(*serviceState)
-	if stateP.count == 4294967295 {
-		stateP.count = 0
+// ServeCloudI handles the service request with the state of a single thread
+func (state *serviceState) ServeCloudI(request *cloudi.Request) (*cloudi.Response, error) {
+	if state.count == 4294967295 {
+		state.count = 0
 	} else {
-		stateP.count += 1
+		state.count += 1
 	}
-	fmt.Printf("count == %d go\n", stateP.count)
-	response := []byte(fmt.Sprintf("%d", stateP.count))
-	api.Return(requestType, name, pattern, []byte{}, response, timeout, transId, pid)
+	fmt.Printf("count == %d go\n", state.count)
+	response := []byte(fmt.Sprintf("%d", state.count))
+	request.API().Return(request.RequestType, request.Name, request.Pattern, []byte{}, response, request.Timeout, request.TransId, request.Source)
 	// execution doesn't reach here
-	return nil, nil, nil
+	return nil, nil
 }
 
-func task(threadIndex uint32, execution *sync.WaitGroup) {
-	defer execution.Done()
-	stateP := &serviceState{count: 0}
-	api, err := cloudi.API(threadIndex, stateP)
-	if err != nil {
-		cloudi.ErrorWrite(os.Stderr, err)
-		return
-	}
-	err = api.Subscribe("go/get", request)
-	if err != nil {
-		cloudi.ErrorWrite(os.Stderr, err)
-		return
-	}
-	_, err = api.Poll(-1)
-	if err != nil {
-		cloudi.ErrorWrite(os.Stderr, err)
-	}
-	os.Stdout.WriteString("terminate count go\n")
+func setup(api *cloudi.Instance) error {
+	return api.SubscribeHandler("go/get", &serviceState{count: 0})
 }
 
 func assert(value interface{}, expected interface{}) {
@@ -79,14 +62,6 @@ func assert(value interface{}, expected interface{}) {
 }
 
 func main() {
-	threadCount, err := cloudi.ThreadCount()
-	if err != nil {
-		cloudi.ErrorExit(os.Stderr, err)
-	}
-	var execution sync.WaitGroup
-	for threadIndex := uint32(0); threadIndex < threadCount; threadIndex++ {
-		execution.Add(1)
-		go task(threadIndex, &execution)
-	}
-	execution.Wait()
+	cloudi.Run(setup)
+	os.Stdout.WriteString("terminate count go\n")
 }
@@ -29,14 +29,13 @@ package main
 import (
 	"cloudi"
 	"fmt"
+	"net/http"
 	"os"
 	"strconv"
-	"sync"
 )
 
-func request(requestType int, name, pattern string, requestInfo, request []byte, timeout uint32, priority int8, transId [16]byte, pid cloudi.Source, state interface{}, api *cloudi.Instance) ([]byte, []byte, error) {
-	httpQs := cloudi.InfoKeyValueParse(request)
-	value := httpQs["value"]
+func request(w http.ResponseWriter, r *http.Request) {
+	value := r.URL.Query()["value"]
 	var valueInt int
 	var err error
 	if value != nil {
@@ -45,55 +44,31 @@ func request(requestType int, name, pattern string, requestInfo, request []byte,
 			value = nil
 		}
 	}
-	var response []byte
+	w.Header().Set("content-type", "text/xml; charset=utf-8")
 	if value == nil {
-		response = []byte("<http_test><error>no value specified</error></http_test>")
+		w.Write([]byte("<http_test><error>no value specified</error></http_test>"))
 	} else {
-		response = []byte(fmt.Sprintf("<http_test><value>%d</value></http_test>", valueInt))
+		fmt.Fprintf(w, "<http_test><value>%d</value></http_test>", valueInt)
 	}
-	var responseInfo []byte
-	responseInfo, err = cloudi.InfoKeyValueNew(map[string][]string{
-		"content-type": {"text/xml; charset=utf-8"},
-	})
-	if err != nil {
-		return nil, nil, err
-	}
-	api.Return(requestType, name, pattern, responseInfo, response, timeout, transId, pid)
-	// execution doesn't reach here
-	return nil, nil, nil
 }
 
-func task(threadIndex uint32, execution *sync.WaitGroup) {
-	defer execution.Done()
-	api, err := cloudi.API(threadIndex, nil)
-	if err != nil {
-		cloudi.ErrorWrite(os.Stderr, err)
-		return
-	}
-	var count1 uint32
-	count1, err = api.SubscribeCount("go.xml/get")
+func setup(api *cloudi.Instance) error {
+	count1, err := api.SubscribeCount("go.xml/get")
 	if err != nil {
-		cloudi.ErrorWrite(os.Stderr, err)
-		return
+		return err
 	}
 	assert(count1, uint32(0))
-	err = api.Subscribe("go.xml/get", request)
+	err = api.SubscribeHandler("go.xml/get", cloudi.HTTPHandler(http.HandlerFunc(request)))
 	if err != nil {
-		cloudi.ErrorWrite(os.Stderr, err)
-		return
+		return err
 	}
 	var count2 uint32
 	count2, err = api.SubscribeCount("go.xml/get")
 	if err != nil {
-		cloudi.ErrorWrite(os.Stderr, err)
-		return
+		return err
 	}
 	assert(count2, uint32(1))
-	_, err = api.Poll(-1)
-	if err != nil {
-		cloudi.ErrorWrite(os.Stderr, err)
-	}
-	os.Stdout.WriteString("terminate http_req go\n")
+	return nil
 }
 
 func assert(value interface{}, expected interface{}) {
@@ -104,14 +79,6 @@ func assert(value interface{}, expected interface{}) {
 }
 
 func main() {
-	threadCount, err := cloudi.ThreadCount()
-	if err != nil {
-		cloudi.ErrorExit(os.Stderr, err)
-	}
-	var execution sync.WaitGroup
-	for threadIndex := uint32(0); threadIndex < threadCount; threadIndex++ {
-		execution.Add(1)
-		go task(threadIndex, &execution)
-	}
-	execution.Wait()
+	cloudi.Run(setup)
+	os.Stdout.WriteString("terminate http_req go\n")
 }
@@ -35,153 +35,116 @@ import (
 	"sort"
 	"strconv"
 	"strings"
-	"sync"
 )
 
-func task(threadIndex uint32, execution *sync.WaitGroup) {
-	defer execution.Done()
-	api, err := cloudi.API(threadIndex, nil)
+func setup(api *cloudi.Instance) error {
+	err := api.SubscribeHandler("a/b/c/d", cloudi.HandlerFunc(sequence1ABCD))
 	if err != nil {
-		cloudi.ErrorWrite(os.Stderr, err)
-		return
+		return err
 	}
-	err = api.Subscribe("a/b/c/d", sequence1ABCD)
+	err = api.SubscribeHandler("a/b/c/*", cloudi.HandlerFunc(sequence1ABCX))
 	if err != nil {
-		cloudi.ErrorWrite(os.Stderr, err)
-		return
+		return err
 	}
-	err = api.Subscribe("a/b/c/*", sequence1ABCX)
+	err = api.SubscribeHandler("a/b/*/d", cloudi.HandlerFunc(sequence1ABXD))
 	if err != nil {
-		cloudi.ErrorWrite(os.Stderr, err)
-		return
+		return err
 	}
-	err = api.Subscribe("a/b/*/d", sequence1ABXD)
+	err = api.SubscribeHandler("a/*/c/d", cloudi.HandlerFunc(sequence1AXCD))
 	if err != nil {
-		cloudi.ErrorWrite(os.Stderr, err)
-		return
+		return err
 	}
-	err = api.Subscribe("a/*/c/d", sequence1AXCD)
+	err = api.SubscribeHandler("*/b/c/d", cloudi.HandlerFunc(sequence1XBCD))
 	if err != nil {
-		cloudi.ErrorWrite(os.Stderr, err)
-		return
+		return err
 	}
-	err = api.Subscribe("*/b/c/d", sequence1XBCD)
+	err = api.SubscribeHandler("a/b/*", cloudi.HandlerFunc(sequence1ABX))
 	if err != nil {
-		cloudi.ErrorWrite(os.Stderr, err)
-		return
+		return err
 	}
-	err = api.Subscribe("a/b/*", sequence1ABX)
+	err = api.SubscribeHandler("a/*/d", cloudi.HandlerFunc(sequence1AXD))
 	if err != nil {
-		cloudi.ErrorWrite(os.Stderr, err)
-		return
+		return err
 	}
-	err = api.Subscribe("a/*/d", sequence1AXD)
+	err = api.SubscribeHandler("*/c/d", cloudi.HandlerFunc(sequence1XCD))
 	if err != nil {
-		cloudi.ErrorWrite(os.Stderr, err)
-		return
+		return err
 	}
-	err = api.Subscribe("*/c/d", sequence1XCD)
+	err = api.SubscribeHandler("a/*", cloudi.HandlerFunc(sequence1AX))
 	if err != nil {
-		cloudi.ErrorWrite(os.Stderr, err)
-		return
+		return err
 	}
-	err = api.Subscribe("a/*", sequence1AX)
+	err = api.SubscribeHandler("*/d", cloudi.HandlerFunc(sequence1XD))
 	if err != nil {
-		cloudi.ErrorWrite(os.Stderr, err)
-		return
+		return err
 	}
-	err = api.Subscribe("*/d", sequence1XD)
+	err = api.SubscribeHandler("*", cloudi.HandlerFunc(sequence1X))
 	if err != nil {
-		cloudi.ErrorWrite(os.Stderr, err)
-		return
+		return err
 	}
-	err = api.Subscribe("*", sequence1X)
+	err = api.SubscribeHandler("sequence1", cloudi.HandlerFunc(sequence1))
 	if err != nil {
-		cloudi.ErrorWrite(os.Stderr, err)
-		return
+		return err
 	}
-	err = api.Subscribe("sequence1", sequence1)
+	err = api.SubscribeHandler("e", cloudi.HandlerFunc(sequence2E1))
 	if err != nil {
-		cloudi.ErrorWrite(os.Stderr, err)
-		return
+		return err
 	}
-	err = api.Subscribe("e", sequence2E1)
+	err = api.SubscribeHandler("e", cloudi.HandlerFunc(sequence2E2))
 	if err != nil {
-		cloudi.ErrorWrite(os.Stderr, err)
-		return
+		return err
 	}
-	err = api.Subscribe("e", sequence2E2)
+	err = api.SubscribeHandler("e", cloudi.HandlerFunc(sequence2E3))
 	if err != nil {
-		cloudi.ErrorWrite(os.Stderr, err)
-		return
+		return err
 	}
-	err = api.Subscribe("e", sequence2E3)
+	err = api.SubscribeHandler("e", cloudi.HandlerFunc(sequence2E4))
 	if err != nil {
-		cloudi.ErrorWrite(os.Stderr, err)
-		return
+		return err
 	}
-	err = api.Subscribe("e", sequence2E4)
+	err = api.SubscribeHandler("e", cloudi.HandlerFunc(sequence2E5))
 	if err != nil {
-		cloudi.ErrorWrite(os.Stderr, err)
-		return
+		return err
 	}
-	err = api.Subscribe("e", sequence2E5)
+	err = api.SubscribeHandler("e", cloudi.HandlerFunc(sequence2E6))
 	if err != nil {
-		cloudi.ErrorWrite(os.Stderr, err)
-		return
+		return err
 	}
-	err = api.Subscribe("e", sequence2E6)
+	err = api.SubscribeHandler("e", cloudi.HandlerFunc(sequence2E7))
 	if err != nil {
-		cloudi.ErrorWrite(os.Stderr, err)
-		return
+		return err
 	}
-	err = api.Subscribe("e", sequence2E7)
+	err = api.SubscribeHandler("e", cloudi.HandlerFunc(sequence2E8))
 	if err != nil {
-		cloudi.ErrorWrite(os.Stderr, err)
-		return
+		return err
 	}
-	err = api.Subscribe("e", sequence2E8)
+	err = api.SubscribeHandler("sequence2", cloudi.HandlerFunc(sequence2))
 	if err != nil {
-		cloudi.ErrorWrite(os.Stderr, err)
-		return
+		return err
 	}
-	err = api.Subscribe("sequence2", sequence2)
+	err = api.SubscribeHandler("f1", cloudi.HandlerFunc(sequence3F1))
 	if err != nil {
-		cloudi.ErrorWrite(os.Stderr, err)
-		return
+		return err
 	}
-	err = api.Subscribe("f1", sequence3F1)
+	err = api.SubscribeHandler("f2", cloudi.HandlerFunc(sequence3F2))
 	if err != nil {
-		cloudi.ErrorWrite(os.Stderr, err)
-		return
+		return err
 	}
-	err = api.Subscribe("f2", sequence3F2)
+	err = api.SubscribeHandler("g1", cloudi.HandlerFunc(sequence3G1))
 	if err != nil {
-		cloudi.ErrorWrite(os.Stderr, err)
-		return
+		return err
 	}
-	err = api.Subscribe("g1", sequence3G1)
+	err = api.SubscribeHandler("sequence3", cloudi.HandlerFunc(sequence3))
 	if err != nil {
-		cloudi.ErrorWrite(os.Stderr, err)
-		return
+		return err
 	}
-	err = api.Subscribe("sequence3", sequence3)
-	if err != nil {
-		cloudi.ErrorWrite(os.Stderr, err)
-		return
-	}
-	if threadIndex == 0 {
+	if api.ThreadIndex() == 0 {
 		_, err = api.SendAsync(api.Prefix()+"sequence1", []byte{}, []byte("1"))
 		if err != nil {
-			cloudi.ErrorWrite(os.Stderr, err)
-			return
+			return err
 		}
 	}
-	_, err = api.Poll(-1)
-	if err != nil {
-		cloudi.ErrorWrite(os.Stderr, err)
-	}
-	os.Stdout.WriteString("terminate messaging go\n")
+	return nil
 }
 
 func assert(value interface{}, expected ...interface{}) {
@@ -193,73 +156,85 @@ func assert(value interface{}, expected ...interface{}) {
 	panic("assert failed!")
 }
 
-func sequence1ABCD(requestType int, name, pattern string, requestInfo, request []byte, timeout uint32, priority int8, transId [16]byte, pid cloudi.Source, state interface{}, api *cloudi.Instance) ([]byte, []byte, error) {
-	assert(pattern, api.Prefix()+"a/b/c/d")
-	assert(request, []byte("test1"))
-	return nil, request, nil
+func sequence1ABCD(request *cloudi.Request) (*cloudi.Response, error) {
+	api := request.API()
+	assert(request.Pattern, api.Prefix()+"a/b/c/d")
+	assert(request.Request, []byte("test1"))
+	return &cloudi.Response{Response: request.Request}, nil
 }
 
-func sequence1ABCX(requestType int, name, pattern string, requestInfo, request []byte, timeout uint32, priority int8, transId [16]byte, pid cloudi.Source, state interface{}, api *cloudi.Instance) ([]byte, []byte, error) {
-	assert(pattern, api.Prefix()+"a/b/c/*")
-	assert(request, []byte("test2"), []byte("test3"))
-	return nil, request, nil
+func sequence1ABCX(request *cloudi.Request) (*cloudi.Response, error) {
+	api := request.API()
+	assert(request.Pattern, api.Prefix()+"a/b/c/*")
+	assert(request.Request, []byte("test2"), []byte("test3"))
+	return &cloudi.Response{Response: request.Request}, nil
 }
 
-func sequence1ABXD(requestType int, name, pattern string, requestInfo, request []byte, timeout uint32, priority int8, transId [16]byte, pid cloudi.Source, state interface{}, api *cloudi.Instance) ([]byte, []byte, error) {
-	assert(pattern, api.Prefix()+"a/b/*/d")
-	assert(request, []byte("test4"), []byte("test5"))
-	return nil, request, nil
+func sequence1ABXD(request *cloudi.Request) (*cloudi.Response, error) {
+	api := request.API()
+	assert(request.Pattern, api.Prefix()+"a/b/*/d")
+	assert(request.Request, []byte("test4"), []byte("test5"))
+	return &cloudi.Response{Response: request.Request}, nil
 }
 
-func sequence1AXCD(requestType int, name, pattern string, requestInfo, request []byte, timeout uint32, priority int8, transId [16]byte, pid cloudi.Source, state interface{}, api *cloudi.Instance) ([]byte, []byte, error) {
-	assert(pattern, api.Prefix()+"a/*/c/d")
-	assert(request, []byte("test6"), []byte("test7"))
-	return nil, request, nil
+func sequence1AXCD(request *cloudi.Request) (*cloudi.Response, error) {
+	api := request.API()
+	assert(request.Pattern, api.Prefix()+"a/*/c/d")
+	assert(request.Request, []byte("test6"), []byte("test7"))
+	return &cloudi.Response{Response: request.Request}, nil
 }
 
-func sequence1XBCD(requestType int, name, pattern string, requestInfo, request []byte, timeout uint32, priority int8, transId [16]byte, pid cloudi.Source, state interface{}, api *cloudi.Instance) ([]byte, []byte, error) {
-	assert(pattern, api.Prefix()+"*/b/c/d")
-	assert(request, []byte("test8"), []byte("test9"))
-	return nil, request, nil
+func sequence1XBCD(request *cloudi.Request) (*cloudi.Response, error) {
+	api := request.API()
+	assert(request.Pattern, api.Prefix()+"*/b/c/d")
+	assert(request.Request, []byte("test8"), []byte("test9"))
+	return &cloudi.Response{Response: request.Request}, nil
 }
 
-func sequence1ABX(requestType int, name, pattern string, requestInfo, request []byte, timeout uint32, priority int8, transId [16]byte, pid cloudi.Source, state interface{}, api *cloudi.Instance) ([]byte, []byte, error) {
-	assert(pattern, api.Prefix()+"a/b/*")
-	assert(request, []byte("test10"))
-	return nil, request, nil
+func sequence1ABX(request *cloudi.Request) (*cloudi.Response, error) {
+	api := request.API()
+	assert(request.Pattern, api.Prefix()+"a/b/*")
+	assert(request.Request, []byte("test10"))
+	return &cloudi.Response{Response: request.Request}, nil
 }
 
-func sequence1AXD(requestType int, name, pattern string, requestInfo, request []byte, timeout uint32, priority int8, transId [16]byte, pid cloudi.Source, state interface{}, api *cloudi.Instance) ([]byte, []byte, error) {
-	assert(pattern, api.Prefix()+"a/*/d")
-	assert(request, []byte("test11"))
-	return nil, request, nil
+func sequence1AXD(request *cloudi.Request) (*cloudi.Response, error) {
+	api := request.API()
+	assert(request.Pattern, api.Prefix()+"a/*/d")
+	assert(request.Request, []byte("test11"))
+	return &cloudi.Response{Response: request.Request}, nil
 }
 
-func sequence1XCD(requestType int, name, pattern string, requestInfo, request []byte, timeout uint32, priority int8, transId [16]byte, pid cloudi.Source, state interface{}, api *cloudi.Instance) ([]byte, []byte, error) {
-	assert(pattern, api.Prefix()+"*/c/d")
-	assert(request, []byte("test12"))
-	return nil, request, nil
+func sequence1XCD(request *cloudi.Request) (*cloudi.Response, error) {
+	api := request.API()
+	assert(request.Pattern, api.Prefix()+"*/c/d")
+	assert(request.Request, []byte("test12"))
+	return &cloudi.Response{Response: request.Request}, nil
 }
 
-func sequence1AX(requestType int, name, pattern string, requestInfo, request []byte, timeout uint32, priority int8, transId [16]byte, pid cloudi.Source, state interface{}, api *cloudi.Instance) ([]byte, []byte, error) {
-	assert(pattern, api.Prefix()+"a/*")
-	assert(request, []byte("test13"))
-	return nil, request, nil
+func sequence1AX(request *cloudi.Request) (*cloudi.Response, error) {
+	api := request.API()
+	assert(request.Pattern, api.Prefix()+"a/*")
+	assert(request.Request, []byte("test13"))
+	return &cloudi.Response{Response: request.Request}, nil
 }
 
-func sequence1XD(requestType int, name, pattern string, requestInfo, request []byte, timeout uint32, priority int8, transId [16]byte, pid cloudi.Source, state interface{}, api *cloudi.Instance) ([]byte, []byte, error) {
-	assert(pattern, api.Prefix()+"*/d")
-	assert(request, []byte("test14"))
-	return nil, request, nil
+func sequence1XD(request *cloudi.Request) (*cloudi.Response, error) {
+	api := request.API()
+	assert(request.Pattern, api.Prefix()+"*/d")
+	assert(request.Request, []byte("test14"))
+	return &cloudi.Response{Response: request.Request}, nil
 }
 
-func sequence1X(requestType int, name, pattern string, requestInfo, request []byte, timeout uint32, priority int8, transId [16]byte, pid cloudi.Source, state interface{}, api *cloudi.Instance) ([]byte, []byte, error) {
-	assert(pattern, api.Prefix()+"*")
-	assert(request, []byte("test15"))
-	return nil, request, nil
+func sequence1X(request *cloudi.Request) (*cloudi.Response, error) {
+	api := request.API()
+	assert(request.Pattern, api.Prefix()+"*")
+	assert(request.Request, []byte("test15"))
+	return &cloudi.Response{Response: request.Request}, nil
 }
 
-func sequence1(requestType int, name, pattern string, requestInfo, request []byte, timeout uint32, priority int8, transId [16]byte, pid cloudi.Source, state interface{}, api *cloudi.Instance) ([]byte, []byte, error) {
+func sequence1(request *cloudi.Request) (*cloudi.Response, error) {
+	api := request.API()
 	var err error
 	// consume all the 'end' responses from all sequences handled
 	// by this service
@@ -272,7 +247,7 @@ func sequence1(requestType int, name, pattern string, requestInfo, request []byt
 		}
 		done = (string(response) != "end")
 	}
-	iteration, err := strconv.ParseUint(string(request), 10, 64)
+	iteration, err := strconv.ParseUint(string(request.Request), 10, 64)
 	if err != nil {
 		panic(err)
 	}
@@ -536,44 +511,45 @@ func sequence1(requestType int, name, pattern string, requestInfo, request []byt
 	assert(test15Id, test15IdCheck)
 	os.Stdout.WriteString(fmt.Sprintf("messaging sequence1 end go (%d)\n", iteration))
 	// start sequence2
-	_, err = api.SendAsync(api.Prefix()+"sequence2", []byte{}, request)
-	return nil, []byte("end"), err
+	_, err = api.SendAsync(api.Prefix()+"sequence2", []byte{}, request.Request)
+	return &cloudi.Response{Response: []byte("end")}, err
 }
 
-func sequence2E1(requestType int, name, pattern string, requestInfo, request []byte, timeout uint32, priority int8, transId [16]byte, pid cloudi.Source, state interface{}, api *cloudi.Instance) ([]byte, []byte, error) {
-	return nil, []byte("1"), nil
+func sequence2E1(request *cloudi.Request) (*cloudi.Response, error) {
+	return &cloudi.Response{Response: []byte("1")}, nil
 }
 
-func sequence2E2(requestType int, name, pattern string, requestInfo, request []byte, timeout uint32, priority int8, transId [16]byte, pid cloudi.Source, state interface{}, api *cloudi.Instance) ([]byte, []byte, error) {
-	return nil, []byte("2"), nil
+func sequence2E2(request *cloudi.Request) (*cloudi.Response, error) {
+	return &cloudi.Response{Response: []byte("2")}, nil
 }
 
-func sequence2E3(requestType int, name, pattern string, requestInfo, request []byte, timeout uint32, priority int8, transId [16]byte, pid cloudi.Source, state interface{}, api *cloudi.Instance) ([]byte, []byte, error) {
-	return nil, []byte("3"), nil
+func sequence2E3(request *cloudi.Request) (*cloudi.Response, error) {
+	return &cloudi.Response{Response: []byte("3")}, nil
 }
 
-func sequence2E4(requestType int, name, pattern string, requestInfo, request []byte, timeout uint32, priority int8, transId [16]byte, pid cloudi.Source, state interface{}, api *cloudi.Instance) ([]byte, []byte, error) {
-	return nil, []byte("4"), nil
+func sequence2E4(request *cloudi.Request) (*cloudi.Response, error) {
+	return &cloudi.Response{Response: []byte("4")}, nil
 }
 
-func sequence2E5(requestType int, name, pattern string, requestInfo, request []byte, timeout uint32, priority int8, transId [16]byte, pid cloudi.Source, state interface{}, api *cloudi.Instance) ([]byte, []byte, error) {
-	return nil, []byte("5"), nil
+func sequence2E5(request *cloudi.Request) (*cloudi.Response, error) {
+	return &cloudi.Response{Response: []byte("5")}, nil
 }
 
-func sequence2E6(requestType int, name, pattern string, requestInfo, request []byte, timeout uint32, priority int8, transId [16]byte, pid cloudi.Source, state interface{}, api *cloudi.Instance) ([]byte, []byte, error) {
-	return nil, []byte("6"), nil
+func sequence2E6(request *cloudi.Request) (*cloudi.Response, error) {
+	return &cloudi.Response{Response: []byte("6")}, nil
 }
 
-func sequence2E7(requestType int, name, pattern string, requestInfo, request []byte, timeout uint32, priority int8, transId [16]byte, pid cloudi.Source, state interface{}, api *cloudi.Instance) ([]byte, []byte, error) {
-	return nil, []byte("7"), nil
+func sequence2E7(request *cloudi.Request) (*cloudi.Response, error) {
+	return &cloudi.Response{Response: []byte("7")}, nil
 }
 
-func sequence2E8(requestType int, name, pattern string, requestInfo, request []byte, timeout uint32, priority int8, transId [16]byte, pid cloudi.Source, state interface{}, api *cloudi.Instance) ([]byte, []byte, error) {
-	return nil, []byte("8"), nil
+func sequence2E8(request *cloudi.Request) (*cloudi.Response, error) {
+	return &cloudi.Response{Response: []byte("8")}, nil
 }
 
-func sequence2(requestType int, name, pattern string, requestInfo, request []byte, timeout uint32, priority int8, transId [16]byte, pid cloudi.Source, state interface{}, api *cloudi.Instance) ([]byte, []byte, error) {
-	iteration, err := strconv.ParseUint(string(request), 10, 64)
+func sequence2(request *cloudi.Request) (*cloudi.Response, error) {
+	api := request.API()
+	iteration, err := strconv.ParseUint(string(request.Request), 10, 64)
 	if err != nil {
 		panic(err)
 	}
@@ -616,39 +592,40 @@ func sequence2(requestType int, name, pattern string, requestInfo, request []byt
 		}
 	}
 	os.Stdout.WriteString(fmt.Sprintf("messaging sequence2 end go (%d)\n", iteration))
-	_, err = api.SendAsync(api.Prefix()+"sequence3", []byte{}, request)
-	return nil, []byte("end"), err
+	_, err = api.SendAsync(api.Prefix()+"sequence3", []byte{}, request.Request)
+	return &cloudi.Response{Response: []byte("end")}, err
 }
 
-func sequence3F1(requestType int, name, pattern string, requestInfo, request []byte, timeout uint32, priority int8, transId [16]byte, pid cloudi.Source, state interface{}, api *cloudi.Instance) ([]byte, []byte, error) {
-	requestI, err := strconv.Atoi(string(request))
+func sequence3F1(request *cloudi.Request) (*cloudi.Response, error) {
+	api := request.API()
+	requestI, err := strconv.Atoi(string(request.Request))
 	if err != nil {
 		panic(err)
 	}
 	if requestI == 4 {
-		return nil, []byte("done"), nil
+		return &cloudi.Response{Response: []byte("done")}, nil
 	}
 	requestNew := requestI + 2 // two steps forward
-	api.Forward(requestType, api.Prefix()+"f2", requestInfo, []byte(fmt.Sprintf("%d", requestNew)), timeout, priority, transId, pid)
-	return nil, nil, nil
+	return request.Forward(api.Prefix()+"f2", request.RequestInfo, []byte(fmt.Sprintf("%d", requestNew)), request.Timeout, request.Priority)
 }
 
-func sequence3F2(requestType int, name, pattern string, requestInfo, request []byte, timeout uint32, priority int8, transId [16]byte, pid cloudi.Source, state interface{}, api *cloudi.Instance) ([]byte, []byte, error) {
-	requestI, err := strconv.Atoi(string(request))
+func sequence3F2(request *cloudi.Request) (*cloudi.Response, error) {
+	api := request.API()
+	requestI, err := strconv.Atoi(string(request.Request))
 	if err != nil {
 		panic(err)
 	}
 	requestNew := requestI - 1 // one step back
-	api.Forward(requestType, api.Prefix()+"f1", requestInfo, []byte(fmt.Sprintf("%d", requestNew)), timeout, priority, transId, pid)
-	return nil, nil, nil
+	return request.Forward(api.Prefix()+"f1", request.RequestInfo, []byte(fmt.Sprintf("%d", requestNew)), request.Timeout, request.Priority)
 }
 
-func sequence3G1(requestType int, name, pattern string, requestInfo, request []byte, timeout uint32, priority int8, transId [16]byte, pid cloudi.Source, state interface{}, api *cloudi.Instance) ([]byte, []byte, error) {
-	return nil, append(request, []byte("suffix")...), nil
+func sequence3G1(request *cloudi.Request) (*cloudi.Response, error) {
+	return &cloudi.Response{Response: append(request.Request, []byte("suffix")...)}, nil
 }
 
-func sequence3(requestType int, name, pattern string, requestInfo, request []byte, timeout uint32, priority int8, transId [16]byte, pid cloudi.Source, state interface{}, api *cloudi.Instance) ([]byte, []byte, error) {
-	iteration, err := strconv.ParseUint(string(request), 10, 64)
+func sequence3(request *cloudi.Request) (*cloudi.Response, error) {
+	api := request.API()
+	iteration, err := strconv.ParseUint(string(request.Request), 10, 64)
 	if err != nil {
 		panic(err)
 	}
@@ -677,18 +654,10 @@ func sequence3(requestType int, name, pattern string, requestInfo, request []byt
 		iteration = 0
 	}
 	_, err = api.SendAsync(api.Prefix()+"sequence1", []byte{}, []byte(fmt.Sprintf("%d", iteration)))
-	return nil, []byte("end"), err
+	return &cloudi.Response{Response: []byte("end")}, err
 }
 
 func main() {
-	threadCount, err := cloudi.ThreadCount()
-	if err != nil {
-		cloudi.ErrorExit(os.Stderr, err)
-	}
-	var execution sync.WaitGroup
-	for threadIndex := uint32(0); threadIndex < threadCount; threadIndex++ {
-		execution.Add(1)
-		go task(threadIndex, &execution)
-	}
-	execution.Wait()
+	cloudi.Run(setup)
+	os.Stdout.WriteString("terminate messaging go\n")
 }
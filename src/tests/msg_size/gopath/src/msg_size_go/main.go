@@ -30,7 +30,6 @@ import (
 	"cloudi"
 	"fmt"
 	"os"
-	"sync"
 	"unsafe"
 )
 
@@ -57,34 +56,11 @@ func request(requestType int, name, pattern string, requestInfo, request []byte,
 	return nil, nil, nil
 }
 
-func task(threadIndex uint32, execution *sync.WaitGroup) {
-	defer execution.Done()
-	api, err := cloudi.API(threadIndex, nil)
-	if err != nil {
-		cloudi.ErrorWrite(os.Stderr, err)
-		return
-	}
-	err = api.Subscribe("go", request)
-	if err != nil {
-		cloudi.ErrorWrite(os.Stderr, err)
-		return
-	}
-	_, err = api.Poll(-1)
-	if err != nil {
-		cloudi.ErrorWrite(os.Stderr, err)
-	}
-	os.Stdout.WriteString("terminate msg_size go\n")
+func setup(api *cloudi.Instance) error {
+	return api.Subscribe("go", request)
 }
 
 func main() {
-	threadCount, err := cloudi.ThreadCount()
-	if err != nil {
-		cloudi.ErrorExit(os.Stderr, err)
-	}
-	var execution sync.WaitGroup
-	for threadIndex := uint32(0); threadIndex < threadCount; threadIndex++ {
-		execution.Add(1)
-		go task(threadIndex, &execution)
-	}
-	execution.Wait()
+	cloudi.Run(setup)
+	os.Stdout.WriteString("terminate msg_size go\n")
 }